@@ -1,10 +1,16 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/hashicorp/go-hclog"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func ServeDiagnosticsServer(pc *PluginConfig, logger hclog.Logger) error {
@@ -15,6 +21,8 @@ func ServeDiagnosticsServer(pc *PluginConfig, logger hclog.Logger) error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health/live", live)
+	mux.HandleFunc("/health/ready", ready)
+	mux.Handle("/metrics", promhttp.Handler())
 
 	if pc.DiagnosticsProfilingEnabled {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -43,3 +51,77 @@ func ServeDiagnosticsServer(pc *PluginConfig, logger hclog.Logger) error {
 func live(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// HealthCheck is named check of plugin dependency, which returns error when dependency isn't healthy
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type healthCheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type readinessResult struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+const readinessTimeout = 5 * time.Second
+
+var readinessChecks = struct {
+	sync.RWMutex
+	checks []HealthCheck
+}{}
+
+// SetReadinessChecks replaces checks run by readiness probe. Plugin isn't ready until checks are set
+func SetReadinessChecks(checks []HealthCheck) {
+	readinessChecks.Lock()
+	defer readinessChecks.Unlock()
+	readinessChecks.checks = checks
+}
+
+func ready(w http.ResponseWriter, r *http.Request) {
+	readinessChecks.RLock()
+	checks := readinessChecks.checks
+	readinessChecks.RUnlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	result := readinessResult{Status: "ready", Checks: make(map[string]healthCheckResult, len(checks))}
+	if checks == nil {
+		result.Status = "not ready"
+	}
+
+	results := make([]healthCheckResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			if err := check.Check(ctx); err != nil {
+				results[i] = healthCheckResult{Status: "fail", Error: err.Error()}
+				return
+			}
+			results[i] = healthCheckResult{Status: "ok"}
+		}(i, check)
+	}
+	wg.Wait()
+
+	for i, check := range checks {
+		result.Checks[check.Name] = results[i]
+		if results[i].Error != "" {
+			result.Status = "not ready"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
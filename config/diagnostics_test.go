@@ -0,0 +1,45 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Ready(testing *testing.T) {
+	defer SetReadinessChecks(nil)
+
+	request := httptest.NewRequest(http.MethodGet, "/health/ready", nil)
+
+	recorder := httptest.NewRecorder()
+	ready(recorder, request)
+	assert.Equal(testing, http.StatusServiceUnavailable, recorder.Code)
+
+	ok := HealthCheck{Name: "ok", Check: func(_ context.Context) error { return nil }}
+	SetReadinessChecks([]HealthCheck{ok})
+
+	recorder = httptest.NewRecorder()
+	ready(recorder, request)
+	assert.Equal(testing, http.StatusOK, recorder.Code)
+
+	failed := HealthCheck{Name: "failed", Check: func(_ context.Context) error { return errors.New("unavailable") }}
+	SetReadinessChecks([]HealthCheck{ok, failed})
+
+	recorder = httptest.NewRecorder()
+	ready(recorder, request)
+	assert.Equal(testing, http.StatusServiceUnavailable, recorder.Code)
+
+	result := readinessResult{}
+	assert.NoError(testing, json.Unmarshal(recorder.Body.Bytes(), &result))
+	assert.Equal(testing, readinessResult{
+		Status: "not ready",
+		Checks: map[string]healthCheckResult{
+			"ok":     {Status: "ok"},
+			"failed": {Status: "fail", Error: "unavailable"},
+		},
+	}, result)
+}
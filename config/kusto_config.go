@@ -1,26 +1,62 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 )
 
-// KustoConfig contains AzureAD service principal and Kusto cluster configs
+const (
+	KustoEnvironmentPrefix = "JAEGER_KUSTO"
+)
+
+// Authentication modes for AzureAD, used to access Kusto cluster
+const (
+	AuthModeClientSecret      = "clientSecret"
+	AuthModeClientCertificate = "clientCertificate"
+	AuthModeManagedIdentity   = "managedIdentity"
+	AuthModeWorkloadIdentity  = "workloadIdentity"
+	AuthModeAzureCli          = "azureCli"
+)
+
+// KustoConfig contains AzureAD service principal and Kusto cluster configs.
+// Any field could reference secret stored elsewhere as "file:<path>" or "env:<variable>"
 type KustoConfig struct {
-	ClientID     string `json:"clientId"`
-	ClientSecret string `json:"clientSecret"`
-	TenantID     string `json:"tenantId"`
-	Endpoint     string `json:"endpoint"`
-	Database     string `json:"database"`
+	AuthMode                  string `json:"authMode"`
+	ClientID                  string `json:"clientId"`
+	ClientSecret              string `json:"clientSecret" secret:"true"`
+	ClientCertificatePath     string `json:"clientCertificatePath"`
+	ClientCertificatePassword string `json:"clientCertificatePassword" secret:"true"`
+	FederatedTokenFile        string `json:"federatedTokenFile"`
+	AuthorityHost             string `json:"authorityHost"`
+	TenantID                  string `json:"tenantId"`
+	Endpoint                  string `json:"endpoint"`
+	Database                  string `json:"database"`
 }
 
 // ParseKustoConfig reads file at path and returns instance of KustoConfig or error
 func ParseKustoConfig(path string) (*KustoConfig, error) {
-	c := &KustoConfig{}
+	c := &KustoConfig{
+		AuthMode: AuthModeClientSecret,
+	}
 
 	if err := load(path, c); err != nil {
 		return nil, err
 	}
 
+	if err := override(KustoEnvironmentPrefix, c); err != nil {
+		return nil, err
+	}
+
+	if err := resolve(c); err != nil {
+		return nil, err
+	}
+
+	if c.AuthMode == AuthModeWorkloadIdentity {
+		c.applyWorkloadIdentityEnvironment()
+	}
+
 	if err := c.Validate(); err != nil {
 		return nil, err
 	}
@@ -28,6 +64,32 @@ func ParseKustoConfig(path string) (*KustoConfig, error) {
 	return c, nil
 }
 
+// applyWorkloadIdentityEnvironment fills missing fields from variables injected by Azure workload identity webhook
+func (kc *KustoConfig) applyWorkloadIdentityEnvironment() {
+	if kc.ClientID == "" {
+		kc.ClientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	if kc.TenantID == "" {
+		kc.TenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if kc.FederatedTokenFile == "" {
+		kc.FederatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	}
+	if kc.AuthorityHost == "" {
+		kc.AuthorityHost = os.Getenv("AZURE_AUTHORITY_HOST")
+	}
+}
+
+// String returns representation of config with secret fields redacted
+func (kc *KustoConfig) String() string {
+	return fmt.Sprintf("%v", redact(kc))
+}
+
+// MarshalJSON returns json representation of config with secret fields redacted
+func (kc *KustoConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redact(kc))
+}
+
 // Validate returns error if any of required fields missing
 func (kc *KustoConfig) Validate() error {
 	if kc.Database == "" {
@@ -36,8 +98,25 @@ func (kc *KustoConfig) Validate() error {
 	if kc.Endpoint == "" {
 		return errors.New("missing endpoint in kusto configuration")
 	}
-	if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
-		return errors.New("missing client configuration (ClientId, ClientSecret, TenantId) for kusto")
+
+	switch kc.AuthMode {
+	case AuthModeClientSecret:
+		if kc.ClientID == "" || kc.ClientSecret == "" || kc.TenantID == "" {
+			return errors.New("missing client configuration (ClientId, ClientSecret, TenantId) for kusto")
+		}
+	case AuthModeClientCertificate:
+		if kc.ClientID == "" || kc.ClientCertificatePath == "" || kc.TenantID == "" {
+			return errors.New("missing client configuration (ClientId, ClientCertificatePath, TenantId) for kusto")
+		}
+	case AuthModeWorkloadIdentity:
+		if kc.ClientID == "" || kc.FederatedTokenFile == "" || kc.TenantID == "" {
+			return errors.New("missing client configuration (ClientId, FederatedTokenFile, TenantId) for kusto")
+		}
+	case AuthModeManagedIdentity, AuthModeAzureCli:
+		// ClientId is optional for managed identity and used to select user-assigned identity
+	default:
+		return fmt.Errorf("unknown auth mode %q in kusto configuration", kc.AuthMode)
 	}
+
 	return nil
 }
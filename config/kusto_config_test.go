@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KustoConfig_Validate(testing *testing.T) {
+	cases := []struct {
+		name   string
+		config KustoConfig
+		valid  bool
+	}{
+		{"client secret", KustoConfig{AuthMode: AuthModeClientSecret, ClientID: "id", ClientSecret: "secret", TenantID: "tenant"}, true},
+		{"client secret without secret", KustoConfig{AuthMode: AuthModeClientSecret, ClientID: "id", TenantID: "tenant"}, false},
+		{"client certificate", KustoConfig{AuthMode: AuthModeClientCertificate, ClientID: "id", ClientCertificatePath: "cert.pfx", TenantID: "tenant"}, true},
+		{"client certificate without path", KustoConfig{AuthMode: AuthModeClientCertificate, ClientID: "id", TenantID: "tenant"}, false},
+		{"workload identity", KustoConfig{AuthMode: AuthModeWorkloadIdentity, ClientID: "id", FederatedTokenFile: "token", TenantID: "tenant"}, true},
+		{"workload identity without token file", KustoConfig{AuthMode: AuthModeWorkloadIdentity, ClientID: "id", TenantID: "tenant"}, false},
+		{"system-assigned managed identity", KustoConfig{AuthMode: AuthModeManagedIdentity}, true},
+		{"user-assigned managed identity", KustoConfig{AuthMode: AuthModeManagedIdentity, ClientID: "id"}, true},
+		{"azure cli", KustoConfig{AuthMode: AuthModeAzureCli}, true},
+		{"unknown mode", KustoConfig{AuthMode: "unknown"}, false},
+	}
+
+	for _, c := range cases {
+		c.config.Database = "database"
+		c.config.Endpoint = "https://cluster.kusto.windows.net"
+
+		err := c.config.Validate()
+
+		if c.valid {
+			assert.NoError(testing, err)
+		} else {
+			assert.Error(testing, err)
+		}
+	}
+}
+
+func Test_KustoConfig_ApplyWorkloadIdentityEnvironment(testing *testing.T) {
+	testing.Setenv("AZURE_AUTHORITY_HOST", "https://login.microsoftonline.us/")
+
+	fromEnvironment := KustoConfig{AuthMode: AuthModeWorkloadIdentity}
+	fromEnvironment.applyWorkloadIdentityEnvironment()
+	assert.Equal(testing, "https://login.microsoftonline.us/", fromEnvironment.AuthorityHost)
+
+	configured := KustoConfig{AuthMode: AuthModeWorkloadIdentity, AuthorityHost: "https://login.chinacloudapi.cn/"}
+	configured.applyWorkloadIdentityEnvironment()
+	assert.Equal(testing, "https://login.chinacloudapi.cn/", configured.AuthorityHost)
+}
@@ -1,43 +1,133 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+)
+
 const (
 	ServiceName             = "jaeger-kusto"
 	PluginEnvironmentPrefix = "JAEGER_KUSTO_PLUGIN"
 )
 
+// Ingestion modes of writer
+const (
+	IngestionModeQueued    = "queued"
+	IngestionModeStreaming = "streaming"
+)
+
+// Formats of batches ingested by writer
+const (
+	WriterFormatCSV  = "csv"
+	WriterFormatJSON = "json"
+)
+
+// Policies applied by writer, when its span buffer is full
+const (
+	OverflowPolicyBlock      = "block"
+	OverflowPolicyDropNewest = "dropNewest"
+	OverflowPolicyDropOldest = "dropOldest"
+	OverflowPolicySample     = "sample"
+)
+
+// Schema validation modes, applied on startup when spans table not matching plugin
+const (
+	SchemaValidationFail = "fail"
+	SchemaValidationWarn = "warn"
+	SchemaValidationOff  = "off"
+)
+
 // PluginConfig contains global options
 type PluginConfig struct {
-	DiagnosticsProfilingEnabled bool    `json:"diagnosticsProfilingEnabled"`
-	DiagnosticsListenAddress    string  `json:"diagnosticsListenAddress"`
-	KustoConfigPath             string  `json:"kustoConfigPath"`
-	LogLevel                    string  `json:"logLevel"`
-	LogJson                     bool    `json:"logJson"`
-	RemoteMode                  bool    `json:"remoteMode"`
-	RemoteListenAddress         string  `json:"remoteListenAddress"`
-	TracingSamplerPercentage    float64 `json:"tracingSamplerPercentage"`
-	TracingRPCMetrics           bool    `json:"tracingRPCMetrics"`
-	WriterBatchMaxBytes         int     `json:"writerBatchMaxBytes"`
-	WriterBatchTimeoutSeconds   int     `json:"writerBatchTimeoutSeconds"`
-	WriterSpanBufferSize        int     `json:"writerSpanBufferSize"`
-	WriterWorkersCount          int     `json:"writerWorkersCount"`
+	ConfigReloadEnabled          bool    `json:"configReloadEnabled"`
+	DiagnosticsProfilingEnabled  bool    `json:"diagnosticsProfilingEnabled"`
+	DiagnosticsListenAddress     string  `json:"diagnosticsListenAddress"`
+	DiagnosticsReadinessFailures int     `json:"diagnosticsReadinessFailures"`
+	KustoConfigPath              string  `json:"kustoConfigPath"`
+	KustoSpansTable              string  `json:"kustoSpansTable"`
+	KustoArchiveTable            string  `json:"kustoArchiveTable"`
+	KustoDependenciesTable       string  `json:"kustoDependenciesTable"`
+	KustoServicesTable           string  `json:"kustoServicesTable"`
+	KustoMappingName             string  `json:"kustoMappingName"`
+	LogLevel                     string  `json:"logLevel"`
+	LogJson                      bool    `json:"logJson"`
+	ReaderDependenciesSpanKinds  bool    `json:"readerDependenciesSpanKinds"`
+	ReaderSearchLogs             bool    `json:"readerSearchLogs"`
+	RemoteMode                   bool    `json:"remoteMode"`
+	RemoteListenAddress          string  `json:"remoteListenAddress"`
+	SchemaRetentionDays          int     `json:"schemaRetentionDays"`
+	SchemaCachingDays            int     `json:"schemaCachingDays"`
+	SchemaBatchingTimeoutSeconds int     `json:"schemaBatchingTimeoutSeconds"`
+	SchemaValidation             string  `json:"schemaValidation"`
+	TracingSamplerPercentage     float64 `json:"tracingSamplerPercentage"`
+	TracingRPCMetrics            bool    `json:"tracingRPCMetrics"`
+	WriterBatchMaxBytes          int     `json:"writerBatchMaxBytes"`
+	WriterBatchTimeoutSeconds    int     `json:"writerBatchTimeoutSeconds"`
+	WriterCompressionMetrics     bool    `json:"writerCompressionMetrics"`
+	WriterDeadLetterPath         string  `json:"writerDeadLetterPath"`
+	WriterDeadLetterMaxBytes     int64   `json:"writerDeadLetterMaxBytes"`
+	WriterDependenciesEnabled    bool    `json:"writerDependenciesEnabled"`
+	WriterIngestionMode          string  `json:"writerIngestionMode"`
+	WriterReplayIntervalSeconds  int     `json:"writerReplayIntervalSeconds"`
+	WriterReportStatus           bool    `json:"writerReportStatus"`
+	WriterStatusTimeoutSeconds   int     `json:"writerStatusTimeoutSeconds"`
+	WriterFormat                 string  `json:"writerFormat"`
+	WriterOverflowPolicy         string  `json:"writerOverflowPolicy"`
+	WriterOverflowTimeoutSeconds int     `json:"writerOverflowTimeoutSeconds"`
+	WriterOverflowSamplePercent  float64 `json:"writerOverflowSamplePercent"`
+	WriterRetryMaxAttempts       int     `json:"writerRetryMaxAttempts"`
+	WriterRetryBackoffSeconds    int     `json:"writerRetryBackoffSeconds"`
+	WriterRetryMaxBackoffSeconds int     `json:"writerRetryMaxBackoffSeconds"`
+	WriterSpanBufferSize         int     `json:"writerSpanBufferSize"`
+	WriterWALPath                string  `json:"writerWALPath"`
+	WriterWorkersCount           int     `json:"writerWorkersCount"`
 }
 
 // NewDefaultPluginConfig returns default configuration options
 func NewDefaultPluginConfig() *PluginConfig {
 	return &PluginConfig{
-		DiagnosticsProfilingEnabled: false,
-		DiagnosticsListenAddress:    ":6060",
-		KustoConfigPath:             "",
-		LogLevel:                    "warn",
-		LogJson:                     false,
-		RemoteMode:                  false,
-		RemoteListenAddress:         "tcp://:8989",
-		TracingSamplerPercentage:    0.0,     // disabled by default
-		TracingRPCMetrics:           false,   // disabled by default
-		WriterBatchMaxBytes:         1048576, // 1 Mb by default
-		WriterBatchTimeoutSeconds:   5,
-		WriterSpanBufferSize:        100,
-		WriterWorkersCount:          5,
+		ConfigReloadEnabled:          false,
+		DiagnosticsProfilingEnabled:  false,
+		DiagnosticsListenAddress:     ":6060",
+		DiagnosticsReadinessFailures: 3,
+		KustoConfigPath:              "",
+		KustoSpansTable:              "Spans",
+		KustoArchiveTable:            "", // archive storage disabled by default
+		KustoDependenciesTable:       "", // computed from spans table by default
+		KustoServicesTable:           "", // computed from spans table by default
+		KustoMappingName:             "JaegerSpanMapping",
+		LogLevel:                     "warn",
+		LogJson:                      false,
+		ReaderDependenciesSpanKinds:  false,
+		ReaderSearchLogs:             true,
+		RemoteMode:                   false,
+		RemoteListenAddress:          "tcp://:8989",
+		SchemaRetentionDays:          0, // policy not changed by default
+		SchemaCachingDays:            0, // policy not changed by default
+		SchemaBatchingTimeoutSeconds: 0, // policy not changed by default
+		SchemaValidation:             SchemaValidationWarn,
+		TracingSamplerPercentage:     0.0,     // disabled by default
+		TracingRPCMetrics:            false,   // disabled by default
+		WriterBatchMaxBytes:          1048576, // 1 Mb by default
+		WriterBatchTimeoutSeconds:    5,
+		WriterCompressionMetrics:     false,
+		WriterDeadLetterPath:         "", // failed batches dropped by default
+		WriterDeadLetterMaxBytes:     1073741824,
+		WriterDependenciesEnabled:    false,
+		WriterIngestionMode:          IngestionModeQueued,
+		WriterReplayIntervalSeconds:  300,
+		WriterReportStatus:           false, // status table slows down ingestion, so disabled by default
+		WriterStatusTimeoutSeconds:   600,
+		WriterFormat:                 WriterFormatCSV,
+		WriterOverflowPolicy:         OverflowPolicyBlock,
+		WriterOverflowTimeoutSeconds: 5,
+		WriterOverflowSamplePercent:  10.0,
+		WriterRetryMaxAttempts:       3,
+		WriterRetryBackoffSeconds:    1,
+		WriterRetryMaxBackoffSeconds: 30,
+		WriterSpanBufferSize:         100,
+		WriterWALPath:                "", // spans buffered in memory by default
+		WriterWorkersCount:           5,
 	}
 }
 
@@ -52,5 +142,70 @@ func ParseConfig(path string) (*PluginConfig, error) {
 		return nil, err
 	}
 
+	if err := pc.Validate(); err != nil {
+		return nil, err
+	}
+
 	return pc, nil
 }
+
+// Validate returns error if any of required fields missing
+func (pc *PluginConfig) Validate() error {
+	if pc.KustoSpansTable == "" {
+		return errors.New("missing spans table name in plugin configuration")
+	}
+	if pc.DiagnosticsReadinessFailures < 0 {
+		return errors.New("diagnostics readiness failures must be non-negative in plugin configuration")
+	}
+	if pc.WriterDependenciesEnabled && pc.KustoDependenciesTable == "" {
+		return errors.New("missing dependencies table name in plugin configuration, required by writer dependencies")
+	}
+	if pc.WriterBatchTimeoutSeconds < 1 {
+		return errors.New("writer batch timeout must be positive in plugin configuration")
+	}
+	if pc.WriterRetryMaxAttempts < 1 {
+		return errors.New("writer retry max attempts must be positive in plugin configuration")
+	}
+	if pc.WriterRetryBackoffSeconds < 0 || pc.WriterRetryMaxBackoffSeconds < pc.WriterRetryBackoffSeconds {
+		return errors.New("writer retry backoff must be non-negative and not exceed max backoff in plugin configuration")
+	}
+	if pc.WriterDeadLetterPath != "" && pc.WriterReplayIntervalSeconds < 1 {
+		return errors.New("writer dead letter replay interval must be positive in plugin configuration")
+	}
+	if pc.WriterDeadLetterMaxBytes < 0 {
+		return errors.New("writer dead letter max bytes must be non-negative in plugin configuration")
+	}
+	if pc.WriterReportStatus && pc.WriterStatusTimeoutSeconds < 1 {
+		return errors.New("writer ingestion status timeout must be positive in plugin configuration")
+	}
+	if pc.WriterWorkersCount < 1 {
+		return errors.New("writer workers count must be positive in plugin configuration")
+	}
+	switch pc.WriterIngestionMode {
+	case IngestionModeQueued, IngestionModeStreaming:
+	default:
+		return fmt.Errorf("unknown writer ingestion mode %q in plugin configuration", pc.WriterIngestionMode)
+	}
+	switch pc.WriterFormat {
+	case WriterFormatCSV, WriterFormatJSON:
+	default:
+		return fmt.Errorf("unknown writer format %q in plugin configuration", pc.WriterFormat)
+	}
+	switch pc.WriterOverflowPolicy {
+	case OverflowPolicyBlock, OverflowPolicyDropNewest, OverflowPolicyDropOldest, OverflowPolicySample:
+	default:
+		return fmt.Errorf("unknown writer overflow policy %q in plugin configuration", pc.WriterOverflowPolicy)
+	}
+	if pc.WriterOverflowTimeoutSeconds < 0 {
+		return errors.New("writer overflow timeout must be non-negative in plugin configuration")
+	}
+	if pc.WriterOverflowSamplePercent < 0 || pc.WriterOverflowSamplePercent > 100 {
+		return errors.New("writer overflow sample percent must be between 0 and 100 in plugin configuration")
+	}
+	switch pc.SchemaValidation {
+	case SchemaValidationFail, SchemaValidationWarn, SchemaValidationOff:
+	default:
+		return fmt.Errorf("unknown schema validation mode %q in plugin configuration", pc.SchemaValidation)
+	}
+	return nil
+}
@@ -3,12 +3,20 @@ package config
 import (
 	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 	"os"
 	"reflect"
+	"strings"
 	"unicode"
 )
 
+const (
+	filePrefix     = "file:"
+	envPrefix      = "env:"
+	redactedString = "<redacted>"
+)
+
 func load(path string, data interface{}) error {
 	if path == "" {
 		return errors.New("empty path to config")
@@ -30,6 +38,28 @@ func load(path string, data interface{}) error {
 	return v.Unmarshal(data)
 }
 
+// WatchConfig invokes onChange every time file at path is modified or replaced
+func WatchConfig(path string, onChange func()) error {
+	if path == "" {
+		return errors.New("empty path to config")
+	}
+
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("json")
+
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	v.OnConfigChange(func(_ fsnotify.Event) {
+		onChange()
+	})
+	v.WatchConfig()
+
+	return nil
+}
+
 func override(prefix string, data interface{}) error {
 	v := viper.New()
 	v.SetEnvPrefix(prefix)
@@ -78,3 +108,66 @@ func toEnvironmentVariable(name string) string {
 
 	return output
 }
+
+// resolve replaces values of string fields having "file:" or "env:" prefix
+// with content of referenced file or environment variable
+func resolve(data interface{}) error {
+	pointer := reflect.ValueOf(data)
+	if pointer.Kind() != reflect.Ptr || pointer.Elem().Kind() != reflect.Struct {
+		return errors.New("data not a pointer to struct")
+	}
+	value := pointer.Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() != reflect.String || !field.CanSet() {
+			continue
+		}
+
+		resolved, err := resolveValue(field.String())
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", value.Type().Field(i).Name, err)
+		}
+		field.SetString(resolved)
+	}
+
+	return nil
+}
+
+func resolveValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, filePrefix):
+		content, err := os.ReadFile(strings.TrimPrefix(value, filePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case strings.HasPrefix(value, envPrefix):
+		name := strings.TrimPrefix(value, envPrefix)
+		content, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return content, nil
+	default:
+		return value, nil
+	}
+}
+
+// redact returns fields of struct keyed by json names, where non-empty fields tagged as secret are masked
+func redact(data interface{}) map[string]interface{} {
+	value := reflect.Indirect(reflect.ValueOf(data))
+	dataType := value.Type()
+
+	fields := make(map[string]interface{}, dataType.NumField())
+	for i := 0; i < dataType.NumField(); i++ {
+		field := dataType.Field(i)
+		if field.Tag.Get("secret") == "true" && !value.Field(i).IsZero() {
+			fields[field.Tag.Get("json")] = redactedString
+			continue
+		}
+		fields[field.Tag.Get("json")] = value.Field(i).Interface()
+	}
+
+	return fields
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"testing"
@@ -32,3 +33,66 @@ func Test_Override(testing *testing.T) {
 	assert.Equal(testing, "override", data.KeyOne)
 	assert.Equal(testing, "initial", data.KeyTwo)
 }
+
+func Test_Resolve(testing *testing.T) {
+	file, err := os.CreateTemp(testing.TempDir(), "secret")
+	if err != nil {
+		testing.Fatal(err)
+	}
+	if _, err := file.WriteString("from-file\n"); err != nil {
+		testing.Fatal(err)
+	}
+	_ = file.Close()
+
+	if err := os.Setenv("TESTING_SECRET", "from-env"); err != nil {
+		testing.Fatal(err)
+	}
+
+	data := &struct {
+		KeyOne   string
+		KeyTwo   string
+		KeyThree string
+	}{
+		KeyOne:   "file:" + file.Name(),
+		KeyTwo:   "env:TESTING_SECRET",
+		KeyThree: "plain",
+	}
+
+	if err := resolve(data); err != nil {
+		testing.Fatal(err)
+	}
+
+	assert.Equal(testing, "from-file", data.KeyOne)
+	assert.Equal(testing, "from-env", data.KeyTwo)
+	assert.Equal(testing, "plain", data.KeyThree)
+}
+
+func Test_Resolve_MissingEnvironment(testing *testing.T) {
+	data := &struct {
+		Key string
+	}{
+		Key: "env:TESTING_MISSING_SECRET",
+	}
+
+	assert.Error(testing, resolve(data))
+}
+
+func Test_Redact(testing *testing.T) {
+	kc := &KustoConfig{
+		ClientID:     "id",
+		ClientSecret: "secret",
+	}
+
+	fields := redact(kc)
+
+	assert.Equal(testing, "id", fields["clientId"])
+	assert.Equal(testing, redactedString, fields["clientSecret"])
+	assert.Equal(testing, "", fields["clientCertificatePassword"])
+	assert.NotContains(testing, kc.String(), ":secret")
+
+	data, err := json.Marshal(kc)
+	if err != nil {
+		testing.Fatal(err)
+	}
+	assert.NotContains(testing, string(data), `"secret"`)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"github.com/dodopizza/jaeger-kusto/runner"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
 	"os"
 
 	"github.com/dodopizza/jaeger-kusto/config"
@@ -11,7 +13,9 @@ import (
 
 func main() {
 	configPath := ""
+	initSchema := false
 	flag.StringVar(&configPath, "config", "", "The path to the plugin's configuration file")
+	flag.BoolVar(&initSchema, "init-schema", false, "Create Kusto tables, ingestion mappings and policies, then exit")
 	flag.Parse()
 
 	pluginConfig, err := config.ParseConfig(configPath)
@@ -32,6 +36,15 @@ func main() {
 		logger.Error("error occurred while reading kusto configuration", "error", err)
 		os.Exit(1)
 	}
+	logger.Info("kusto config", "config", kustoConfig)
+
+	if initSchema {
+		if err := store.InitSchema(pluginConfig, kustoConfig, logger); err != nil {
+			logger.Error("error occurred while initializing kusto schema", "error", err)
+			os.Exit(2)
+		}
+		return
+	}
 
 	kustoStore, err := store.NewStore(pluginConfig, kustoConfig, logger)
 	if err != nil {
@@ -39,8 +52,52 @@ func main() {
 		os.Exit(2)
 	}
 
+	if healthChecker, ok := kustoStore.(store.HealthChecker); ok {
+		config.SetReadinessChecks(healthChecker.ReadinessChecks())
+	}
+
+	if pluginConfig.ConfigReloadEnabled {
+		if err := watchConfig(configPath, pluginConfig.KustoConfigPath, kustoStore, logger); err != nil {
+			logger.Error("error occurred while watching configuration", "error", err)
+			os.Exit(2)
+		}
+	}
+
 	if err := runner.Serve(pluginConfig, kustoStore, logger); err != nil {
 		logger.Error("error occurred while invoking runner", "error", err)
 		os.Exit(3)
 	}
 }
+
+func watchConfig(configPath, kustoConfigPath string, kustoStore shared.StoragePlugin, logger hclog.Logger) error {
+	reloader, ok := kustoStore.(store.Reloader)
+	if !ok {
+		return nil
+	}
+
+	reload := func() {
+		pluginConfig, err := config.ParseConfig(configPath)
+		if err != nil {
+			logger.Error("error occurred while reloading plugin configuration", "error", err)
+			return
+		}
+		kustoConfig, err := config.ParseKustoConfig(kustoConfigPath)
+		if err != nil {
+			logger.Error("error occurred while reloading kusto configuration", "error", err)
+			return
+		}
+		if err := reloader.Reload(pluginConfig, kustoConfig); err != nil {
+			logger.Error("error occurred while applying reloaded configuration", "error", err)
+			return
+		}
+		logger.Info("configuration reloaded")
+	}
+
+	for _, path := range []string{configPath, kustoConfigPath} {
+		if err := config.WatchConfig(path, reload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
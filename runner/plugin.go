@@ -10,7 +10,8 @@ import (
 
 func servePlugin(c *config.PluginConfig, store shared.StoragePlugin, logger hclog.Logger) error {
 	pluginServices := shared.PluginServices{
-		Store: store,
+		Store:        store,
+		ArchiveStore: archiveStore(store),
 	}
 
 	tracer, closer, err := config.NewPluginTracer(c)
@@ -18,7 +18,8 @@ import (
 
 func serveServer(c *config.PluginConfig, store shared.StoragePlugin, logger hclog.Logger) error {
 	plugin := shared.StorageGRPCPlugin{
-		Impl: store,
+		Impl:        store,
+		ArchiveImpl: archiveStore(store),
 	}
 
 	tracer, closer, err := config.NewPluginTracer(c)
@@ -69,8 +70,8 @@ func registerGracefulShutdown(server *grpc.Server, store shared.StoragePlugin, l
 		logger.Info("received signal, attempting gracefully stop server and plugin", "signal", sig)
 		server.GracefulStop()
 
-		// perform cleanup logic on writer
-		c, ok := store.SpanWriter().(io.Closer)
+		// perform cleanup logic on store: dependencies job and writers
+		c, ok := store.(io.Closer)
 		if ok {
 			_ = c.Close()
 		}
@@ -16,6 +16,15 @@ func Serve(c *config.PluginConfig, store shared.StoragePlugin, logger hclog.Logg
 	return servePlugin(c, store, logger)
 }
 
+// archiveStore returns archive storage implemented by store, or nil if archive storage disabled
+func archiveStore(store shared.StoragePlugin) shared.ArchiveStoragePlugin {
+	archive, ok := store.(shared.ArchiveStoragePlugin)
+	if !ok || archive.ArchiveSpanReader() == nil || archive.ArchiveSpanWriter() == nil {
+		return nil
+	}
+	return archive
+}
+
 func newGRPCServerWithTracer(tracer opentracing.Tracer) *grpc.Server {
 	return grpc.NewServer(
 		grpc.UnaryInterceptor(ot.OpenTracingServerInterceptor(tracer)),
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/dodopizza/jaeger-kusto/config"
+)
+
+// newKustoAuthorization returns authorization for Kusto client according to configured auth mode
+func newKustoAuthorization(kc *config.KustoConfig) (kusto.Authorization, error) {
+	switch kc.AuthMode {
+	case config.AuthModeManagedIdentity:
+		msi := auth.NewMSIConfig()
+		msi.ClientID = kc.ClientID
+		return kusto.Authorization{Config: msi}, nil
+
+	case config.AuthModeClientCertificate:
+		certificate := auth.NewClientCertificateConfig(kc.ClientCertificatePath, kc.ClientCertificatePassword, kc.ClientID, kc.TenantID)
+		certificate.Resource = kc.Endpoint
+		authorizer, err := certificate.Authorizer()
+		if err != nil {
+			return kusto.Authorization{}, err
+		}
+		return kusto.Authorization{Authorizer: authorizer}, nil
+
+	case config.AuthModeWorkloadIdentity:
+		authorizer, err := newWorkloadIdentityAuthorizer(kc)
+		if err != nil {
+			return kusto.Authorization{}, err
+		}
+		return kusto.Authorization{Authorizer: authorizer}, nil
+
+	case config.AuthModeAzureCli:
+		authorizer, err := auth.NewAuthorizerFromCLIWithResource(kc.Endpoint)
+		if err != nil {
+			return kusto.Authorization{}, err
+		}
+		return kusto.Authorization{Authorizer: authorizer}, nil
+
+	default:
+		return kusto.Authorization{
+			Config: auth.NewClientCredentialsConfig(
+				kc.ClientID,
+				kc.ClientSecret,
+				kc.TenantID,
+			),
+		}, nil
+	}
+}
+
+func newWorkloadIdentityAuthorizer(kc *config.KustoConfig) (autorest.Authorizer, error) {
+	oauthConfig, err := adal.NewOAuthConfig(authorityHost(kc), kc.TenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := adal.NewServicePrincipalTokenWithSecret(
+		*oauthConfig,
+		kc.ClientID,
+		kc.Endpoint,
+		&federatedTokenSecret{tokenFile: kc.FederatedTokenFile},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// authorityHost returns configured AzureAD authority, or authority of public cloud if none is set
+func authorityHost(kc *config.KustoConfig) string {
+	if kc.AuthorityHost != "" {
+		return kc.AuthorityHost
+	}
+	return azure.PublicCloud.ActiveDirectoryEndpoint
+}
+
+// federatedTokenSecret implements adal.ServicePrincipalSecret with federated token (client assertion),
+// which is read from file on every token refresh, because token in file is rotated by kubelet
+type federatedTokenSecret struct {
+	tokenFile string
+}
+
+// SetAuthenticationValues populates the form submitted during token acquisition with federated token
+func (s *federatedTokenSecret) SetAuthenticationValues(_ *adal.ServicePrincipalToken, v *url.Values) error {
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read federated token file: %w", err)
+	}
+
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (s federatedTokenSecret) MarshalJSON() ([]byte, error) {
+	type tokenType struct {
+		Type string `json:"type"`
+	}
+	return json.Marshal(tokenType{
+		Type: "FederatedTokenSecret",
+	})
+}
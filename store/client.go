@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/dodopizza/jaeger-kusto/config"
+)
+
+// kustoClient wraps Kusto client, so it could be replaced, when credentials or endpoint changed.
+// Ingestion uses it to fetch ingestion resources, so new client picked up by ingestion as well
+type kustoClient struct {
+	mu     sync.RWMutex
+	client *kusto.Client
+}
+
+func newKustoClient(kc *config.KustoConfig) (*kustoClient, error) {
+	client, err := connectKusto(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kustoClient{client: client}, nil
+}
+
+func connectKusto(kc *config.KustoConfig) (*kusto.Client, error) {
+	authorizer, err := newKustoAuthorization(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	return kusto.New(kc.Endpoint, authorizer)
+}
+
+// Reload replaces underlying client with new one, created from provided config
+func (c *kustoClient) Reload(kc *config.KustoConfig) error {
+	client, err := connectKusto(kc)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.client = client
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *kustoClient) current() *kusto.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+func (c *kustoClient) Auth() kusto.Authorization {
+	return c.current().Auth()
+}
+
+func (c *kustoClient) Endpoint() string {
+	return c.current().Endpoint()
+}
+
+func (c *kustoClient) Query(ctx context.Context, db string, query kusto.Stmt, options ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	return c.current().Query(ctx, db, query, options...)
+}
+
+func (c *kustoClient) Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error) {
+	return c.current().Mgmt(ctx, db, query, options...)
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+)
+
+// retryPolicy describes how failed ingestion attempts are retried
+type retryPolicy struct {
+	MaxAttempts int
+	Initial     time.Duration
+	Max         time.Duration
+}
+
+func newRetryPolicy(pc *config.PluginConfig) *retryPolicy {
+	return &retryPolicy{
+		MaxAttempts: pc.WriterRetryMaxAttempts,
+		Initial:     time.Duration(pc.WriterRetryBackoffSeconds) * time.Second,
+		Max:         time.Duration(pc.WriterRetryMaxBackoffSeconds) * time.Second,
+	}
+}
+
+// Backoff returns delay before next attempt: exponentially growing from initial up to max with full jitter,
+// so workers failing at the same time don't retry in lockstep
+func (p *retryPolicy) Backoff(attempt int) time.Duration {
+	if p.Initial <= 0 {
+		return 0
+	}
+
+	delay := p.Max
+	if attempt < 32 {
+		if exp := p.Initial << (attempt - 1); exp > 0 && exp < p.Max {
+			delay = exp
+		}
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// errDeadLetterFull is returned by spill, when dead letter directory reached its size limit
+var errDeadLetterFull = errors.New("dead letter directory is full")
+
+// deadLetter stores batches, which failed to ingest, as files in directory, so they can be ingested later
+type deadLetter struct {
+	mu       sync.Mutex
+	path     string
+	table    string
+	maxBytes int64
+	files    *regexp.Regexp
+}
+
+func newDeadLetter(path, table string, maxBytes int64) (*deadLetter, error) {
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+	return &deadLetter{
+		path:     path,
+		table:    table,
+		maxBytes: maxBytes,
+		files:    tableFilePattern(table, `_\d+_\d+`, ""),
+	}, nil
+}
+
+// Spill writes batch to new file named after table, so dead letter directory can be shared between tables.
+// Batch is rejected, if it doesn't fit into directory size limit (zero means no limit)
+func (d *deadLetter) Spill(payload []byte, format string) (string, error) {
+	// concurrent workers must not pass size check together
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.maxBytes > 0 {
+		size, err := d.Size()
+		if err != nil {
+			return "", err
+		}
+		if size+int64(len(payload)) > d.maxBytes {
+			return "", errDeadLetterFull
+		}
+	}
+
+	name := fmt.Sprintf("%s_%d_%d.%s", d.table, time.Now().UnixNano(), rand.Int63(), format)
+	path := filepath.Join(d.path, name)
+
+	// write to temporary file first, so replay never picks partially written batch
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, payload, 0o640); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Size returns total size of spilled batches of table
+func (d *deadLetter) Size() (int64, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || !d.files.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// file removed by replay after directory was read
+			continue
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+// Files returns spilled batches of table in order they were written
+func (d *deadLetter) Files() ([]string, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !d.files.MatchString(entry.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(d.path, entry.Name()))
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// replayDeadLetterLoop replays spilled batches on start and then periodically until writer is closed
+func (kw *kustoSpanWriter) replayDeadLetterLoop(interval time.Duration) {
+	defer kw.shutdownWg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		kw.replayDeadLetter()
+
+		select {
+		case <-ticker.C:
+		case <-kw.closing:
+			return
+		}
+	}
+}
+
+// replayDeadLetter ingests spilled batches. Replay stops on first failure or writer close,
+// remaining batches are left for next replay
+func (kw *kustoSpanWriter) replayDeadLetter() {
+	files, err := kw.deadLetter.Files()
+	if err != nil {
+		kw.logger.Error("Failed to list dead letter batches", "error", err)
+		return
+	}
+
+	for _, path := range files {
+		select {
+		case <-kw.closing:
+			return
+		default:
+		}
+
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			kw.logger.Error("Failed to read dead letter batch", "path", path, "error", err)
+			return
+		}
+
+		format := strings.TrimPrefix(filepath.Ext(path), ".")
+		if err := kw.ingestWithRetry(payload, format); err != nil {
+			kw.logger.Error("Failed to replay dead letter batch", "path", path, "error", err)
+			return
+		}
+
+		if err := os.Remove(path); err != nil {
+			kw.logger.Error("Failed to remove replayed dead letter batch", "path", path, "error", err)
+			return
+		}
+		kw.logger.Info("Replayed dead letter batch", "path", path, "batchSize", len(payload))
+	}
+}
+
+// tableFilePattern matches names of files written for table: table name, layout specific part,
+// format extension and optional suffix. Matching is anchored, so tables sharing prefix (like Spans
+// and Spans_2024) don't pick files of each other
+func tableFilePattern(table, layout, suffix string) *regexp.Regexp {
+	formats := regexp.QuoteMeta(config.WriterFormatCSV) + "|" + regexp.QuoteMeta(config.WriterFormatJSON)
+	return regexp.MustCompile("^" + regexp.QuoteMeta(table) + layout + `\.(` + formats + ")" + regexp.QuoteMeta(suffix) + "$")
+}
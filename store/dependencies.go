@@ -0,0 +1,284 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// dependencyEdgesQuery counts calls between child spans and their parents of different services.
+// It expects Spans (candidate parents) and Children to be defined by let statements and have SpanKind column.
+// Parent is taken from the first CHILD_OF reference to the same trace, as in ParentSpanID column,
+// which is empty for spans ingested before the column was added
+const dependencyEdgesQuery = `
+Children
+| extend ParentSpanID = column_ifexists("ParentSpanID", "")
+| mv-apply Reference = References on (
+    where tostring(Reference.refType) == "CHILD_OF" and tostring(Reference.traceID) == TraceID
+    | take 1
+    | project ReferencedSpanID = tostring(Reference.spanID))
+| extend ParentSpanID = coalesce(ParentSpanID, ReferencedSpanID)
+| project TraceID, ParentSpanID, Child = ProcessServiceName, ChildKind = SpanKind
+| join kind=inner (Spans | project TraceID, SpanID, Parent = ProcessServiceName, ParentKind = SpanKind) on $left.TraceID == $right.TraceID, $left.ParentSpanID == $right.SpanID
+| where Parent != Child
+| summarize CallCount = count() by Parent, ParentKind, Child, ChildKind`
+
+// dependenciesColumns are columns of table with dependencies aggregated by hour
+var dependenciesColumns = []kustoColumn{
+	{Name: "Timestamp", Type: "datetime"},
+	{Name: "Parent", Type: "string"},
+	{Name: "ParentKind", Type: "string"},
+	{Name: "Child", Type: "string"},
+	{Name: "ChildKind", Type: "string"},
+	{Name: "CallCount", Type: "long"},
+}
+
+const (
+	// dependenciesJobInterval is how often dependencies job looks for hours to aggregate
+	dependenciesJobInterval = 5 * time.Minute
+	// dependenciesHourTimeout limits aggregation of single hour
+	dependenciesHourTimeout = 5 * time.Minute
+	// dependenciesDelay is time given to spans of hour to be ingested, before the hour is aggregated
+	dependenciesDelay = 15 * time.Minute
+	// dependenciesBackfill is how many hours back are aggregated, if they are missing in dependencies table
+	dependenciesBackfill = 24
+)
+
+// dependencyEdge is number of calls between parent and child spans of different services with given span kinds
+type dependencyEdge struct {
+	Parent     string     `kusto:"Parent"`
+	ParentKind string     `kusto:"ParentKind"`
+	Child      string     `kusto:"Child"`
+	ChildKind  string     `kusto:"ChildKind"`
+	CallCount  value.Long `kusto:"CallCount"`
+}
+
+// spanKindPairs are kinds of parent and child spans, which make a call between services
+var spanKindPairs = map[string]string{
+	"client":   "server",
+	"producer": "consumer",
+}
+
+// isCall returns true if edge is a call between services. When span kinds are used, edge between spans
+// with known kinds is a call only for client/server or producer/consumer pair
+func (e dependencyEdge) isCall(spanKinds bool) bool {
+	if e.Parent == e.Child {
+		return false
+	}
+	if !spanKinds || e.ParentKind == "" || e.ChildKind == "" {
+		return true
+	}
+	return spanKindPairs[e.ParentKind] == e.ChildKind
+}
+
+// hasDependenciesMarker returns true if edges of dependencies table contain marker row of aggregated hour,
+// so the range is aggregated by dependencies job at least partially
+func hasDependenciesMarker(edges []dependencyEdge) bool {
+	for _, edge := range edges {
+		if edge.Parent == "" && edge.Child == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// dependencyLinks sums calls of edges by parent and child services
+func dependencyLinks(edges []dependencyEdge, spanKinds bool) []model.DependencyLink {
+	type link struct {
+		Parent string
+		Child  string
+	}
+
+	calls := make(map[link]uint64)
+	for _, edge := range edges {
+		if !edge.isCall(spanKinds) {
+			continue
+		}
+		calls[link{Parent: edge.Parent, Child: edge.Child}] += uint64(edge.CallCount.Value)
+	}
+
+	dependencyLinks := make([]model.DependencyLink, 0, len(calls))
+	for l, count := range calls {
+		dependencyLinks = append(dependencyLinks, model.DependencyLink{
+			Parent:    l.Parent,
+			Child:     l.Child,
+			CallCount: count,
+		})
+	}
+	sort.Slice(dependencyLinks, func(i, j int) bool {
+		if dependencyLinks[i].Parent != dependencyLinks[j].Parent {
+			return dependencyLinks[i].Parent < dependencyLinks[j].Parent
+		}
+		return dependencyLinks[i].Child < dependencyLinks[j].Child
+	})
+
+	return dependencyLinks
+}
+
+// dependenciesCommand returns management command, which appends calls of hour to dependencies table.
+// Calls of hour are appended once: repeated command (for example, by another plugin instance) is skipped by ingestion tag.
+// Marker row with empty services and no calls is appended too, so hour without calls is found as aggregated
+func dependenciesCommand(spansTable, dependenciesTable string, hour time.Time) (string, error) {
+	spans, err := quoteTableName(spansTable)
+	if err != nil {
+		return "", err
+	}
+	dependencies, err := quoteTableName(dependenciesTable)
+	if err != nil {
+		return "", err
+	}
+
+	from := hour.UTC().Format(time.RFC3339)
+	to := hour.Add(time.Hour).UTC().Format(time.RFC3339)
+	// parent of span may start in previous hour
+	parentsFrom := hour.Add(-time.Hour).UTC().Format(time.RFC3339)
+	tag := fmt.Sprintf("jaeger-dependencies;%s;%s", spansTable, from)
+
+	return fmt.Sprintf(`.set-or-append %s with (tags='["ingest-by:%s"]', ingestIfNotExists='["%s"]') <|
+let Spans = %s
+| where StartTime >= datetime(%s) and StartTime < datetime(%s)
+| extend SpanKind = coalesce(column_ifexists("SpanKind", ""), tostring(Tags.span_kind));
+let Children = Spans | where StartTime >= datetime(%s);%s
+| project Timestamp = datetime(%s), Parent, ParentKind, Child, ChildKind, CallCount
+| union (print Timestamp = datetime(%s), Parent = "", ParentKind = "", Child = "", ChildKind = "", CallCount = long(0))`,
+		dependencies, tag, tag, spans, parentsFrom, to, from, dependencyEdgesQuery, from, from), nil
+}
+
+// dependenciesJob periodically aggregates calls between services by hour into dependencies table,
+// so reader doesn't join spans of the whole lookback on every request
+type dependenciesJob struct {
+	factory *kustoFactory
+	logger  hclog.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newDependenciesJob(factory *kustoFactory, logger hclog.Logger) *dependenciesJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dependenciesJob{
+		factory: factory,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// Run aggregates missing hours on start and then every dependenciesJobInterval, until job is closed
+func (j *dependenciesJob) Run() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(dependenciesJobInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.aggregate(time.Now()); err != nil && j.ctx.Err() == nil {
+			j.logger.Error("Failed to aggregate dependencies", "table", j.factory.Tables.Dependencies, "error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-j.ctx.Done():
+			return
+		}
+	}
+}
+
+// Close cancels running aggregation and waits for job to stop
+func (j *dependenciesJob) Close() {
+	j.cancel()
+	<-j.done
+}
+
+// aggregate appends complete hours, which are missing in dependencies table
+func (j *dependenciesJob) aggregate(now time.Time) error {
+	hours := dependenciesHours(now)
+
+	aggregated, err := j.aggregatedHours(hours[0])
+	if err != nil {
+		return err
+	}
+
+	for _, hour := range hours {
+		if aggregated[hour] {
+			continue
+		}
+		if err := j.aggregateHour(hour); err != nil {
+			return err
+		}
+		j.logger.Debug("Aggregated dependencies", "table", j.factory.Tables.Dependencies, "hour", hour)
+	}
+
+	return nil
+}
+
+// aggregateHour appends calls of hour to dependencies table, each hour has its own timeout during backfill
+func (j *dependenciesJob) aggregateHour(hour time.Time) error {
+	ctx, cancel := context.WithTimeout(j.ctx, dependenciesHourTimeout)
+	defer cancel()
+
+	command, err := dependenciesCommand(j.factory.Tables.Spans, j.factory.Tables.Dependencies, hour)
+	if err != nil {
+		return err
+	}
+
+	return execMgmt(ctx, j.factory.Mgmt(), j.factory.Database, command)
+}
+
+// dependenciesHours returns starts of complete hours to aggregate, oldest first
+func dependenciesHours(now time.Time) []time.Time {
+	last := now.UTC().Add(-dependenciesDelay).Truncate(time.Hour).Add(-time.Hour)
+
+	hours := make([]time.Time, 0, dependenciesBackfill)
+	for i := dependenciesBackfill - 1; i >= 0; i-- {
+		hours = append(hours, last.Add(-time.Duration(i)*time.Hour))
+	}
+	return hours
+}
+
+// aggregatedHours returns hours, which are already present in dependencies table (at least by marker row)
+func (j *dependenciesJob) aggregatedHours(from time.Time) (map[time.Time]bool, error) {
+	ctx, cancel := context.WithTimeout(j.ctx, 30*time.Second)
+	defer cancel()
+
+	kustoStmt := kusto.NewStmt(`table(ParamTable) | where Timestamp >= ParamFrom | distinct Timestamp`).MustDefinitions(
+		kusto.NewDefinitions().Must(
+			kusto.ParamTypes{
+				"ParamTable": kusto.ParamType{Type: types.String},
+				"ParamFrom":  kusto.ParamType{Type: types.DateTime},
+			},
+		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamTable": j.factory.Tables.Dependencies, "ParamFrom": from}))
+
+	iter, err := j.factory.Reader().Query(ctx, j.factory.Database, kustoStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Stop()
+
+	type aggregatedHour struct {
+		Timestamp time.Time `kusto:"Timestamp"`
+	}
+
+	aggregated := make(map[time.Time]bool)
+	err = iter.Do(
+		func(row *table.Row) error {
+			rec := aggregatedHour{}
+			if err := row.ToStruct(&rec); err != nil {
+				return err
+			}
+			aggregated[rec.Timestamp.UTC()] = true
+			return nil
+		},
+	)
+
+	return aggregated, err
+}
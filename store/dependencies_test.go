@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SpanParentID(testing *testing.T) {
+	traceID := model.NewTraceID(0, 1)
+	otherTraceID := model.NewTraceID(0, 2)
+
+	cases := []struct {
+		name       string
+		references []model.SpanRef
+		parentID   string
+	}{
+		{"root", nil, ""},
+		{"child of", []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(3))}, model.NewSpanID(3).String()},
+		{"follows from only", []model.SpanRef{model.NewFollowsFromRef(traceID, model.NewSpanID(3))}, ""},
+		{"follows from before child of", []model.SpanRef{
+			model.NewFollowsFromRef(traceID, model.NewSpanID(3)),
+			model.NewChildOfRef(traceID, model.NewSpanID(4)),
+		}, model.NewSpanID(4).String()},
+		{"multiple child of", []model.SpanRef{
+			model.NewChildOfRef(traceID, model.NewSpanID(4)),
+			model.NewChildOfRef(traceID, model.NewSpanID(5)),
+		}, model.NewSpanID(4).String()},
+		{"child of other trace", []model.SpanRef{model.NewChildOfRef(otherTraceID, model.NewSpanID(3))}, ""},
+	}
+
+	for _, c := range cases {
+		span := &model.Span{TraceID: traceID, SpanID: model.NewSpanID(2), References: c.references}
+
+		assert.Equal(testing, c.parentID, spanParentID(span))
+	}
+}
+
+func edge(parent, parentKind, child, childKind string, calls int64) dependencyEdge {
+	return dependencyEdge{
+		Parent:     parent,
+		ParentKind: parentKind,
+		Child:      child,
+		ChildKind:  childKind,
+		CallCount:  value.Long{Value: calls, Valid: true},
+	}
+}
+
+func Test_DependencyLinks(testing *testing.T) {
+	cases := []struct {
+		name      string
+		edges     []dependencyEdge
+		spanKinds bool
+		links     []model.DependencyLink
+	}{
+		{
+			name: "client server call",
+			edges: []dependencyEdge{
+				edge("frontend", "server", "frontend", "client", 10),
+				edge("frontend", "client", "backend", "server", 10),
+			},
+			links: []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 10}},
+		},
+		{
+			name: "calls summed by services",
+			edges: []dependencyEdge{
+				edge("frontend", "client", "backend", "server", 10),
+				edge("frontend", "", "backend", "", 5),
+				edge("backend", "client", "db", "server", 1),
+			},
+			links: []model.DependencyLink{
+				{Parent: "backend", Child: "db", CallCount: 1},
+				{Parent: "frontend", Child: "backend", CallCount: 15},
+			},
+		},
+		{
+			name: "server to client without span kinds",
+			edges: []dependencyEdge{
+				edge("frontend", "server", "library", "client", 3),
+			},
+			links: []model.DependencyLink{{Parent: "frontend", Child: "library", CallCount: 3}},
+		},
+		{
+			name: "server to client with span kinds",
+			edges: []dependencyEdge{
+				edge("frontend", "server", "library", "client", 3),
+				edge("frontend", "client", "backend", "server", 10),
+			},
+			spanKinds: true,
+			links:     []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 10}},
+		},
+		{
+			name: "producer consumer with span kinds",
+			edges: []dependencyEdge{
+				edge("orders", "producer", "billing", "consumer", 7),
+			},
+			spanKinds: true,
+			links:     []model.DependencyLink{{Parent: "orders", Child: "billing", CallCount: 7}},
+		},
+		{
+			name: "unknown kinds with span kinds",
+			edges: []dependencyEdge{
+				edge("frontend", "", "backend", "server", 2),
+			},
+			spanKinds: true,
+			links:     []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 2}},
+		},
+		{
+			name:  "no edges",
+			edges: nil,
+			links: []model.DependencyLink{},
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(testing, c.links, dependencyLinks(c.edges, c.spanKinds))
+	}
+}
+
+func Test_KustoSpanReader_GetDependencies(testing *testing.T) {
+	client := &fakeReaderClient{}
+	reader := newTestSpanReader(client)
+
+	_, err := reader.GetDependencies(context.Background(), time.Now(), time.Hour)
+	assert.Equal(testing, errQueryCaptured, err)
+
+	query := client.stmt.String()
+	assert.Contains(testing, query, `where tostring(Reference.refType) == "CHILD_OF" and tostring(Reference.traceID) == TraceID`)
+	assert.Contains(testing, query, "on $left.TraceID == $right.TraceID, $left.ParentSpanID == $right.SpanID")
+	assert.NotContains(testing, query, "References[0]")
+}
+
+func Test_KustoSpanReader_GetDependencies_Aggregated(testing *testing.T) {
+	client := &fakeReaderClient{}
+	reader := newTestSpanReader(client)
+	reader.tables.Dependencies = "Dependencies"
+
+	_, err := reader.GetDependencies(context.Background(), time.Now(), time.Hour)
+	assert.Equal(testing, errQueryCaptured, err)
+
+	query := client.stmt.String()
+	assert.Contains(testing, query, "| where Timestamp >= bin(ParamEndTs-ParamLookBack, 1h) and Timestamp < ParamEndTs\n| summarize CallCount = sum(CallCount) by Parent, ParentKind, Child, ChildKind")
+	assert.NotContains(testing, query, "join")
+
+	params, err := client.stmt.ValuesJSON()
+	assert.NoError(testing, err)
+	assert.Contains(testing, params, `"ParamTable":"Dependencies"`)
+}
+
+func Test_HasDependenciesMarker(testing *testing.T) {
+	calls := []dependencyEdge{edge("frontend", "client", "backend", "server", 2)}
+	assert.False(testing, hasDependenciesMarker(nil))
+	assert.False(testing, hasDependenciesMarker(calls))
+
+	aggregated := append(calls, edge("", "", "", "", 0))
+	assert.True(testing, hasDependenciesMarker(aggregated))
+	assert.Equal(testing, []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 2}}, dependencyLinks(aggregated, true))
+}
+
+func Test_DependenciesHours(testing *testing.T) {
+	now := time.Date(2022, time.March, 10, 12, 10, 0, 0, time.UTC)
+
+	hours := dependenciesHours(now)
+
+	assert.Len(testing, hours, dependenciesBackfill)
+	// 11:00-12:00 isn't complete with ingestion delay yet
+	assert.Equal(testing, time.Date(2022, time.March, 10, 10, 0, 0, 0, time.UTC), hours[len(hours)-1])
+	assert.Equal(testing, time.Date(2022, time.March, 9, 11, 0, 0, 0, time.UTC), hours[0])
+}
+
+func Test_DependenciesCommand(testing *testing.T) {
+	hour := time.Date(2022, time.March, 10, 10, 0, 0, 0, time.UTC)
+
+	command, err := dependenciesCommand("Spans", "Dependencies", hour)
+	assert.NoError(testing, err)
+	assert.Contains(testing, command, `.set-or-append ['Dependencies'] with (tags='["ingest-by:jaeger-dependencies;Spans;2022-03-10T10:00:00Z"]', ingestIfNotExists='["jaeger-dependencies;Spans;2022-03-10T10:00:00Z"]')`)
+	assert.Contains(testing, command, "let Spans = ['Spans']\n| where StartTime >= datetime(2022-03-10T09:00:00Z) and StartTime < datetime(2022-03-10T11:00:00Z)")
+	assert.Contains(testing, command, "let Children = Spans | where StartTime >= datetime(2022-03-10T10:00:00Z);")
+	assert.Contains(testing, command, "| project Timestamp = datetime(2022-03-10T10:00:00Z), Parent, ParentKind, Child, ChildKind, CallCount")
+	// marker row makes hour without calls aggregated
+	assert.Contains(testing, command, `| union (print Timestamp = datetime(2022-03-10T10:00:00Z), Parent = "", ParentKind = "", Child = "", ChildKind = "", CallCount = long(0))`)
+
+	_, err = dependenciesCommand("Spans", "Dependencies']", hour)
+	assert.Error(testing, err)
+}
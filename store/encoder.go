@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/tushar2708/altcsv"
+)
+
+// spanEncoder appends span rows, produced by TransformSpanToStringArray, to batch buffer
+type spanEncoder interface {
+	Encode(row []string) error
+}
+
+func newSpanEncoder(format string, b *bytes.Buffer) spanEncoder {
+	if format == config.WriterFormatJSON {
+		return &jsonSpanEncoder{
+			b:       b,
+			columns: kustoSpanColumns(),
+		}
+	}
+
+	writer := altcsv.NewWriter(b)
+	writer.AllQuotes = true
+	return &csvSpanEncoder{writer: writer}
+}
+
+// ingestionFormat returns data format of batches encoded in configured writer format
+func ingestionFormat(format string) ingest.DataFormat {
+	if format == config.WriterFormatJSON {
+		return ingest.JSON
+	}
+	return ingest.CSV
+}
+
+type csvSpanEncoder struct {
+	writer *altcsv.Writer
+}
+
+func (e *csvSpanEncoder) Encode(row []string) error {
+	if err := e.writer.Write(row); err != nil {
+		return err
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// jsonSpanEncoder writes rows as newline-delimited json objects, keyed by column names,
+// where dynamic and numeric columns are stored as native json values
+type jsonSpanEncoder struct {
+	b       *bytes.Buffer
+	columns []kustoColumn
+}
+
+func (e *jsonSpanEncoder) Encode(row []string) error {
+	if len(row) != len(e.columns) {
+		return fmt.Errorf("span row has %d values, but table has %d columns", len(row), len(e.columns))
+	}
+
+	line := &bytes.Buffer{}
+	line.WriteByte('{')
+	for i, column := range e.columns {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+
+		name, err := json.Marshal(column.Name)
+		if err != nil {
+			return err
+		}
+		line.Write(name)
+		line.WriteByte(':')
+
+		switch {
+		case column.Type == "string" || column.Type == "datetime" || column.Type == "timespan":
+			value, err := json.Marshal(row[i])
+			if err != nil {
+				return err
+			}
+			line.Write(value)
+		case row[i] == "":
+			line.WriteString("null")
+		default:
+			line.WriteString(row[i])
+		}
+	}
+	line.WriteString("}\n")
+
+	_, err := e.b.Write(line.Bytes())
+	return err
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_JsonSpanEncoder(testing *testing.T) {
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(2),
+		OperationName: "operation \"quoted\"",
+		Flags:         1,
+		StartTime:     time.Date(2020, time.June, 10, 13, 0, 0, 0, time.UTC),
+		Duration:      time.Second,
+		Tags:          []model.KeyValue{model.String("http.method", "GET")},
+		Process:       &model.Process{ServiceName: "service"},
+	}
+	row, err := TransformSpanToStringArray(span)
+	assert.NoError(testing, err)
+
+	b := &bytes.Buffer{}
+	encoder := newSpanEncoder(config.WriterFormatJSON, b)
+	assert.NoError(testing, encoder.Encode(row))
+	assert.NoError(testing, encoder.Encode(row))
+
+	lines := bytes.Split(bytes.TrimSpace(b.Bytes()), []byte("\n"))
+	assert.Len(testing, lines, 2)
+
+	var decoded map[string]interface{}
+	assert.NoError(testing, json.Unmarshal(lines[0], &decoded))
+	assert.Equal(testing, span.TraceID.String(), decoded["TraceID"])
+	assert.Equal(testing, "operation \"quoted\"", decoded["OperationName"])
+	assert.Equal(testing, float64(1), decoded["Flags"])
+	assert.Equal(testing, "00:00:01", decoded["Duration"])
+	assert.Equal(testing, map[string]interface{}{"http_method": "GET"}, decoded["Tags"])
+	assert.Len(testing, decoded, len(kustoSpanColumns()))
+}
+
+func Test_JsonSpanEncoder_ColumnsMismatch(testing *testing.T) {
+	encoder := newSpanEncoder(config.WriterFormatJSON, &bytes.Buffer{})
+
+	assert.Error(testing, encoder.Encode([]string{"trace"}))
+}
@@ -1,7 +1,6 @@
 package store
 
 import (
-	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/ingest"
 	"github.com/dodopizza/jaeger-kusto/config"
 )
@@ -9,23 +8,71 @@ import (
 type kustoFactory struct {
 	PluginConfig *config.PluginConfig
 	Database     string
-	Table        string
-	client       *kusto.Client
+	Tables       *kustoTables
+	client       *kustoClient
+	// newIngest creates ingestion client of table instead of Kusto ingestion, used by tests
+	newIngest func(table string) (kustoIngest, error)
 }
 
-func newKustoFactory(client *kusto.Client, pc *config.PluginConfig, database string) *kustoFactory {
+// kustoTables contains names of tables used by plugin in the Kusto database
+type kustoTables struct {
+	Spans        string
+	Archive      string
+	Dependencies string
+	Services     string
+}
+
+func newKustoFactory(client *kustoClient, pc *config.PluginConfig, database string) *kustoFactory {
 	return &kustoFactory{
 		client:       client,
 		Database:     database,
-		Table:        "Spans",
+		Tables:       newKustoTables(pc),
 		PluginConfig: pc,
 	}
 }
 
+func newKustoTables(pc *config.PluginConfig) *kustoTables {
+	tables := &kustoTables{
+		Spans:        pc.KustoSpansTable,
+		Archive:      pc.KustoArchiveTable,
+		Dependencies: pc.KustoDependenciesTable,
+		Services:     pc.KustoServicesTable,
+	}
+
+	// services and operations are derived from spans table, unless dedicated table configured
+	if tables.Services == "" {
+		tables.Services = tables.Spans
+	}
+
+	return tables
+}
+
+// Archive returns factory, which reads and writes spans using archive table
+func (f *kustoFactory) Archive() *kustoFactory {
+	return &kustoFactory{
+		client:   f.client,
+		Database: f.Database,
+		Tables: &kustoTables{
+			Spans:    f.Tables.Archive,
+			Archive:  f.Tables.Archive,
+			Services: f.Tables.Archive,
+		},
+		PluginConfig: f.PluginConfig,
+		newIngest:    f.newIngest,
+	}
+}
+
 func (f *kustoFactory) Reader() kustoReaderClient {
 	return f.client
 }
 
+func (f *kustoFactory) Mgmt() kustoMgmtClient {
+	return f.client
+}
+
 func (f *kustoFactory) Ingest() (kustoIngest, error) {
-	return ingest.New(f.client, f.Database, f.Table)
+	if f.newIngest != nil {
+		return f.newIngest(f.Tables.Spans)
+	}
+	return ingest.New(f.client, f.Database, f.Tables.Spans)
 }
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/dodopizza/jaeger-kusto/config"
+)
+
+// HealthChecker is implemented by storage, which can report readiness of its dependencies
+type HealthChecker interface {
+	ReadinessChecks() []config.HealthCheck
+}
+
+// ReadinessChecks returns checks of Kusto connectivity, ingestion clients and recent ingestions
+func (store *store) ReadinessChecks() []config.HealthCheck {
+	return []config.HealthCheck{
+		{Name: "kusto", Check: store.checkKusto},
+		{Name: "ingest", Check: store.checkIngest},
+		{Name: "ingestion", Check: store.checkIngestion},
+	}
+}
+
+// checkKusto runs trivial query against configured database
+func (store *store) checkKusto(ctx context.Context) error {
+	iter, err := store.client.Query(ctx, store.kustoConfig.Database, kusto.NewStmt("print Ready = 1"))
+	if err != nil {
+		return err
+	}
+	defer iter.Stop()
+
+	return iter.Do(func(_ *table.Row) error {
+		return nil
+	})
+}
+
+// checkIngest verifies that ingestion clients of writers were created
+func (store *store) checkIngest(_ context.Context) error {
+	for _, writer := range store.writers {
+		if in, _ := writer.ingestOptions(); in == nil {
+			return fmt.Errorf("ingest client of table %s not created", writer.table)
+		}
+	}
+	return nil
+}
+
+// checkIngestion fails, when recent batches of any writer failed all ingestion attempts or were rejected by Kusto
+func (store *store) checkIngestion(_ context.Context) error {
+	if store.readinessFailures == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, writer := range store.writers {
+		if failed := writer.FailedBatches(); failed >= store.readinessFailures {
+			errs = append(errs, fmt.Sprintf("%d consecutive batches of table %s failed to ingest", failed, writer.table))
+		}
+		if writer.status == nil {
+			continue
+		}
+		if rejected := writer.status.FailedBatches(); rejected >= store.readinessFailures {
+			errs = append(errs, fmt.Sprintf("%d consecutive batches of table %s rejected by kusto", rejected, writer.table))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
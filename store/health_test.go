@@ -0,0 +1,24 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Store_CheckIngestion(testing *testing.T) {
+	writer := &kustoSpanWriter{table: "Spans", ingest: &fakeIngest{}}
+	store := &store{writers: []*kustoSpanWriter{writer}, readinessFailures: 2}
+
+	assert.NoError(testing, store.checkIngest(context.Background()))
+
+	writer.failedBatches = 1
+	assert.NoError(testing, store.checkIngestion(context.Background()))
+
+	writer.failedBatches = 2
+	assert.EqualError(testing, store.checkIngestion(context.Background()), "2 consecutive batches of table Spans failed to ingest")
+
+	store.readinessFailures = 0
+	assert.NoError(testing, store.checkIngestion(context.Background()))
+}
@@ -23,11 +23,19 @@ type kustoSpan struct {
 	ProcessServiceName string        `kusto:"ProcessServiceName"`
 	ProcessTags        value.Dynamic `kusto:"ProcessTags"`
 	ProcessID          string        `kusto:"ProcessID"`
+	SpanKind           string        `kusto:"SpanKind"`
+	HasError           bool          `kusto:"HasError"`
+	StatusCode         string        `kusto:"StatusCode"`
+	ParentSpanID       string        `kusto:"ParentSpanID"`
 }
 
 const (
 	// TagDotReplacementCharacter state which character should replace the dot in dynamic column
 	TagDotReplacementCharacter = "_"
+
+	errorTag      = "error"
+	statusCodeTag = "otel.status_code"
+	statusError   = "ERROR"
 )
 
 func transformKustoSpanToModelSpan(kustoSpan *kustoSpan) (*model.Span, error) {
@@ -98,6 +106,27 @@ func transformKustoSpanToModelSpan(kustoSpan *kustoSpan) (*model.Span, error) {
 	return span, err
 }
 
+// spanStatus returns status code of span from otel.status_code tag and whether span is marked as failed
+// either by error tag or by error status code
+func spanStatus(span *model.Span) (statusCode string, hasError bool) {
+	tags := model.KeyValues(span.Tags)
+	if tag, ok := tags.FindByKey(statusCodeTag); ok {
+		statusCode = tag.AsString()
+	}
+	if tag, ok := tags.FindByKey(errorTag); ok {
+		hasError = tag.AsString() == "true"
+	}
+	return statusCode, hasError || statusCode == statusError
+}
+
+// spanParentID returns id of parent span from first child-of reference of the same trace, or empty string for root span
+func spanParentID(span *model.Span) string {
+	if parentID := span.ParentSpanID(); parentID != 0 {
+		return parentID.String()
+	}
+	return ""
+}
+
 func getTagsValues(tags []model.KeyValue) []string {
 	var values []string
 	for i := range tags {
@@ -129,6 +158,9 @@ func TransformSpanToStringArray(span *model.Span) ([]string, error) {
 		return nil, err
 	}
 
+	spanKind, _ := span.GetSpanKind()
+	statusCode, hasError := spanStatus(span)
+
 	kustoStringSpan := []string{
 		span.TraceID.String(),
 		span.SpanID.String(),
@@ -142,6 +174,10 @@ func TransformSpanToStringArray(span *model.Span) ([]string, error) {
 		span.Process.ServiceName,
 		string(processTags),
 		span.ProcessID,
+		spanKind,
+		strconv.FormatBool(hasError),
+		statusCode,
+		spanParentID(span),
 	}
 
 	return kustoStringSpan, err
@@ -0,0 +1,181 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "jaeger_kusto"
+
+var (
+	writerOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "overflows_total",
+		Help:      "Number of spans written, when span buffer of writer was full",
+	}, []string{"table", "policy"})
+
+	writerSpansDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "spans_dropped_total",
+		Help:      "Number of spans dropped by writer, because span buffer was full",
+	}, []string{"table", "reason"})
+
+	writerSpansReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "spans_received_total",
+		Help:      "Number of spans received by writer",
+	}, []string{"table"})
+
+	writerBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "batches_total",
+		Help:      "Number of batches passed to ingestion by trigger: size, time, shutdown, stop or segment",
+	}, []string{"table", "trigger"})
+
+	writerBatchBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "batch_bytes",
+		Help:      "Size of batches passed to ingestion",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"table"})
+
+	writerBatchCompressedBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "batch_compressed_bytes",
+		Help:      "Size of batches passed to ingestion after gzip compression, measured when writerCompressionMetrics is enabled",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"table"})
+
+	writerIngestionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "ingestion_duration_seconds",
+		Help:      "Duration of single ingestion attempt by ingestion mode",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"table", "mode"})
+
+	writerIngestionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "ingestion_failures_total",
+		Help:      "Number of failed ingestion attempts by ingestion mode",
+	}, []string{"table", "mode"})
+
+	writerBatchesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "batches_failed_total",
+		Help:      "Number of batches failed all ingestion attempts by outcome: dropped, spilled or kept",
+	}, []string{"table", "outcome"})
+
+	writerIngestionResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "writer",
+		Name:      "ingestion_results_total",
+		Help:      "Number of queued batches by ingestion result reported by Kusto: succeeded, failed or unknown",
+	}, []string{"table", "result"})
+
+	readerQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reader",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of Kusto queries by reader method",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"table", "method"})
+
+	readerQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reader",
+		Name:      "query_errors_total",
+		Help:      "Number of failed Kusto queries by reader method",
+	}, []string{"table", "method"})
+)
+
+// writerBuffers exposes backlog of writers: occupancy of span buffer or sealed write-ahead log segments
+// waiting for workers. Backlog of writers of the same table (like writer recreated on reconfiguration) is summed
+var writerBuffers = newWriterBufferCollector()
+
+func init() {
+	prometheus.MustRegister(writerBuffers)
+}
+
+type writerBufferCollector struct {
+	mu       sync.Mutex
+	writers  map[*kustoSpanWriter]struct{}
+	spans    *prometheus.Desc
+	segments *prometheus.Desc
+}
+
+func newWriterBufferCollector() *writerBufferCollector {
+	return &writerBufferCollector{
+		writers: map[*kustoSpanWriter]struct{}{},
+		spans: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "writer", "buffered_spans"),
+			"Number of spans waiting in writer span buffer",
+			[]string{"table"}, nil,
+		),
+		segments: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "writer", "wal_pending_segments"),
+			"Number of sealed write-ahead log segments waiting for writer workers",
+			[]string{"table"}, nil,
+		),
+	}
+}
+
+// Add starts reporting backlog of writer
+func (c *writerBufferCollector) Add(kw *kustoSpanWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writers[kw] = struct{}{}
+}
+
+// Remove stops reporting backlog of closed writer
+func (c *writerBufferCollector) Remove(kw *kustoSpanWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.writers, kw)
+}
+
+func (c *writerBufferCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.spans
+	ch <- c.segments
+}
+
+func (c *writerBufferCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	spans := map[string]int{}
+	segments := map[string]int{}
+	for kw := range c.writers {
+		if kw.wal != nil {
+			segments[kw.table] += kw.wal.Pending()
+			continue
+		}
+		spans[kw.table] += len(kw.spanInput)
+	}
+
+	for table, value := range spans {
+		ch <- prometheus.MustNewConstMetric(c.spans, prometheus.GaugeValue, float64(value), table)
+	}
+	for table, value := range segments {
+		ch <- prometheus.MustNewConstMetric(c.segments, prometheus.GaugeValue, float64(value), table)
+	}
+}
+
+// observeQuery records duration and result of reader query started at start
+func observeQuery(table, method string, start time.Time, err error) {
+	readerQueryDuration.WithLabelValues(table, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		readerQueryErrors.WithLabelValues(table, method).Inc()
+	}
+}
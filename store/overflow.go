@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reasons of spans dropped by writer
+const (
+	dropReasonTimeout  = "timeout"
+	dropReasonCanceled = "canceled"
+	dropReasonNewest   = "newest"
+	dropReasonOldest   = "oldest"
+	dropReasonSampled  = "sampled"
+)
+
+// overflowPolicy describes how writer handles spans, when its span buffer is full
+type overflowPolicy struct {
+	Policy        string
+	Timeout       time.Duration
+	SamplePercent float64
+}
+
+func newOverflowPolicy(pc *config.PluginConfig) overflowPolicy {
+	return overflowPolicy{
+		Policy:        pc.WriterOverflowPolicy,
+		Timeout:       time.Duration(pc.WriterOverflowTimeoutSeconds) * time.Second,
+		SamplePercent: pc.WriterOverflowSamplePercent,
+	}
+}
+
+// Sampled returns true if spans of trace are kept by sample policy
+func (p overflowPolicy) Sampled(traceID model.TraceID) bool {
+	return float64(traceID.Low%10000) < p.SamplePercent*100
+}
+
+// enqueue sends span row to workers and applies overflow policy, when span buffer is full
+func (kw *kustoSpanWriter) enqueue(ctx context.Context, traceID model.TraceID, row []string) error {
+	select {
+	case kw.spanInput <- row:
+		return nil
+	default:
+	}
+
+	policy := kw.overflowOptions()
+	writerOverflows.WithLabelValues(kw.table, policy.Policy).Inc()
+
+	switch policy.Policy {
+	case config.OverflowPolicyDropNewest:
+		return kw.dropSpan(dropReasonNewest)
+	case config.OverflowPolicyDropOldest:
+		kw.enqueueDroppingOldest(row)
+		return nil
+	case config.OverflowPolicySample:
+		if !policy.Sampled(traceID) {
+			return kw.dropSpan(dropReasonSampled)
+		}
+	}
+
+	return kw.enqueueWithTimeout(ctx, row, policy.Timeout)
+}
+
+// enqueueWithTimeout waits for free space in span buffer until timeout (if positive) or context is done
+func (kw *kustoSpanWriter) enqueueWithTimeout(ctx context.Context, row []string, timeout time.Duration) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case kw.spanInput <- row:
+		return nil
+	case <-ctx.Done():
+		writerSpansDropped.WithLabelValues(kw.table, dropReasonCanceled).Inc()
+		return status.FromContextError(ctx.Err()).Err()
+	case <-expired:
+		return kw.dropSpan(dropReasonTimeout)
+	}
+}
+
+// enqueueDroppingOldest takes out oldest spans from span buffer, until there is space for new one
+func (kw *kustoSpanWriter) enqueueDroppingOldest(row []string) {
+	for {
+		select {
+		case kw.spanInput <- row:
+			return
+		default:
+		}
+
+		select {
+		case <-kw.spanInput:
+			writerSpansDropped.WithLabelValues(kw.table, dropReasonOldest).Inc()
+		default:
+		}
+	}
+}
+
+func (kw *kustoSpanWriter) dropSpan(reason string) error {
+	writerSpansDropped.WithLabelValues(kw.table, reason).Inc()
+	return status.Errorf(codes.ResourceExhausted, "span dropped by kusto writer: span buffer is full (%s)", reason)
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestOverflowWriter(policy string) *kustoSpanWriter {
+	writer := &kustoSpanWriter{
+		spanInput: make(chan []string, 1),
+		overflow:  overflowPolicy{Policy: policy, Timeout: 10 * time.Millisecond, SamplePercent: 50},
+	}
+	writer.spanInput <- []string{"oldest"}
+	return writer
+}
+
+func Test_KustoSpanWriter_Enqueue(testing *testing.T) {
+	cases := []struct {
+		name    string
+		policy  string
+		traceID model.TraceID
+		code    codes.Code
+		queued  string
+		dropped string
+	}{
+		{"block", config.OverflowPolicyBlock, model.NewTraceID(0, 1), codes.ResourceExhausted, "oldest", dropReasonTimeout},
+		{"drop newest", config.OverflowPolicyDropNewest, model.NewTraceID(0, 1), codes.ResourceExhausted, "oldest", dropReasonNewest},
+		{"drop oldest", config.OverflowPolicyDropOldest, model.NewTraceID(0, 1), codes.OK, "newest", dropReasonOldest},
+		// kept trace waits for free space and is dropped by timeout, other trace is dropped at once
+		{"sample kept", config.OverflowPolicySample, model.NewTraceID(0, 1), codes.ResourceExhausted, "oldest", dropReasonTimeout},
+		{"sample dropped", config.OverflowPolicySample, model.NewTraceID(0, 9999), codes.ResourceExhausted, "oldest", dropReasonSampled},
+	}
+
+	reasons := []string{dropReasonTimeout, dropReasonNewest, dropReasonOldest, dropReasonSampled}
+	for _, c := range cases {
+		writer := newTestOverflowWriter(c.policy)
+		writer.table = "Test_KustoSpanWriter_Enqueue_" + c.name
+
+		err := writer.enqueue(context.Background(), c.traceID, []string{"newest"})
+
+		assert.Equal(testing, c.code, status.Code(err))
+		assert.Equal(testing, []string{c.queued}, <-writer.spanInput)
+		for _, reason := range reasons {
+			expected := 0.0
+			if reason == c.dropped {
+				expected = 1.0
+			}
+			assert.Equal(testing, expected, testutil.ToFloat64(writerSpansDropped.WithLabelValues(writer.table, reason)), reason)
+		}
+	}
+}
+
+func Test_KustoSpanWriter_Enqueue_ContextCanceled(testing *testing.T) {
+	writer := newTestOverflowWriter(config.OverflowPolicyBlock)
+	writer.overflow.Timeout = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := writer.enqueue(ctx, model.NewTraceID(0, 1), []string{"newest"})
+
+	assert.Equal(testing, codes.Canceled, status.Code(err))
+}
+
+func Test_OverflowPolicy_Sampled(testing *testing.T) {
+	policy := overflowPolicy{SamplePercent: 10}
+
+	assert.True(testing, policy.Sampled(model.NewTraceID(1, 999)))
+	assert.False(testing, policy.Sampled(model.NewTraceID(1, 1000)))
+	assert.False(testing, overflowPolicy{SamplePercent: 0}.Sampled(model.NewTraceID(1, 0)))
+	assert.True(testing, overflowPolicy{SamplePercent: 100}.Sampled(model.NewTraceID(1, 9999)))
+}
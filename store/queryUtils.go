@@ -22,6 +22,12 @@ var (
 
 	// ErrStartAndEndTimeNotSet occurs when start time and end time are not set
 	ErrStartAndEndTimeNotSet = errors.New("start and End Time must be set")
+
+	// ErrInvalidTagKey occurs when tag key is empty or contains control characters
+	ErrInvalidTagKey = errors.New("tag key must be non-empty and must not contain control characters")
+
+	// ErrInvalidTagValue occurs when tag value has operator with invalid operand
+	ErrInvalidTagValue = errors.New("invalid tag value")
 )
 
 // taken from https://github.com/logzio/jaeger-logzio/blob/master/store/queryUtils.go
@@ -32,6 +38,9 @@ func validateQuery(p *spanstore.TraceQueryParameters) error {
 	if p.ServiceName == "" && len(p.Tags) > 0 {
 		return ErrServiceNameNotSet
 	}
+	if _, _, err := tagFilters(p.Tags); err != nil {
+		return err
+	}
 	if p.StartTimeMin.IsZero() || p.StartTimeMax.IsZero() {
 		return ErrStartAndEndTimeNotSet
 	}
@@ -2,15 +2,10 @@ package store
 
 import (
 	"context"
-	"fmt"
-	"strings"
 	"time"
 
-	"github.com/Azure/azure-kusto-go/kusto/data/value"
 	"github.com/hashicorp/go-hclog"
 
-	"github.com/Azure/azure-kusto-go/kusto/unsafe"
-
 	"github.com/Azure/azure-kusto-go/kusto"
 	"github.com/Azure/azure-kusto-go/kusto/data/table"
 	"github.com/Azure/azure-kusto-go/kusto/data/types"
@@ -19,9 +14,12 @@ import (
 )
 
 type kustoSpanReader struct {
-	client   kustoReaderClient
-	database string
-	logger   hclog.Logger
+	client              kustoReaderClient
+	database            string
+	tables              *kustoTables
+	dependencySpanKinds bool
+	searchLogs          bool
+	logger              hclog.Logger
 }
 
 type kustoReaderClient interface {
@@ -32,25 +30,24 @@ func newKustoSpanReader(factory *kustoFactory, logger hclog.Logger) (*kustoSpanR
 	return &kustoSpanReader{
 		factory.Reader(),
 		factory.Database,
+		factory.Tables,
+		factory.PluginConfig.ReaderDependenciesSpanKinds,
+		factory.PluginConfig.ReaderSearchLogs,
 		logger,
 	}, nil
 }
 
 const defaultNumTraces = 20
 
-var safetySwitch = unsafe.Stmt{
-	Add:             true,
-	SuppressWarning: true,
-}
-
 // GetTrace finds trace by TraceID
 func (r *kustoSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	kustoStmt := kusto.NewStmt("Spans | where TraceID == ParamTraceID").MustDefinitions(
+	kustoStmt := kusto.NewStmt("table(ParamTable) | where TraceID == ParamTraceID").MustDefinitions(
 		kusto.NewDefinitions().Must(
 			kusto.ParamTypes{
+				"ParamTable":   kusto.ParamType{Type: types.String},
 				"ParamTraceID": kusto.ParamType{Type: types.String},
 			},
-		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamTraceID": traceID.String()}))
+		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamTable": r.tables.Spans, "ParamTraceID": traceID.String()}))
 
 	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
@@ -82,7 +79,14 @@ func (r *kustoSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (
 
 // GetServices finds all possible services that spanstore contains
 func (r *kustoSpanReader) GetServices(ctx context.Context) ([]string, error) {
-	iter, err := r.client.Query(ctx, r.database, kusto.NewStmt("set query_results_cache_max_age = time(5m); Spans | summarize by ProcessServiceName | sort by ProcessServiceName asc"))
+	kustoStmt := kusto.NewStmt("set query_results_cache_max_age = time(5m); table(ParamTable) | summarize by ProcessServiceName | sort by ProcessServiceName asc").MustDefinitions(
+		kusto.NewDefinitions().Must(
+			kusto.ParamTypes{
+				"ParamTable": kusto.ParamType{Type: types.String},
+			},
+		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamTable": r.tables.Services}))
+
+	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
 		return nil, err
 	}
@@ -117,27 +121,33 @@ func (r *kustoSpanReader) GetOperations(ctx context.Context, query spanstore.Ope
 		SpanKind      string `kusto:"SpanKind"`
 	}
 
-	var kustoStmt kusto.Stmt
-	if query.ServiceName == "" && query.SpanKind == "" {
-		kustoStmt = kusto.NewStmt(`Spans
-| summarize count() by OperationName
-| sort by count_
-| project-away count_`)
+	kustoStmt := kusto.NewStmt("table(ParamTable)")
+	kustoDefinitions := kusto.ParamTypes{"ParamTable": kusto.ParamType{Type: types.String}}
+	kustoParameters := kusto.QueryValues{"ParamTable": r.tables.Services}
+
+	if query.ServiceName != "" {
+		kustoStmt = kustoStmt.Add(` | where ProcessServiceName == ParamProcessServiceName`)
+		kustoDefinitions["ParamProcessServiceName"] = kusto.ParamType{Type: types.String}
+		kustoParameters["ParamProcessServiceName"] = query.ServiceName
 	}
 
-	if query.ServiceName != "" && query.SpanKind == "" {
-		kustoStmt = kusto.NewStmt(`Spans
-| where ProcessServiceName == ParamProcessServiceName
-| summarize count() by OperationName
-| sort by count_
-| project-away count_`).MustDefinitions(
-			kusto.NewDefinitions().Must(
-				kusto.ParamTypes{
-					"ParamProcessServiceName": kusto.ParamType{Type: types.String},
-				},
-			)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamProcessServiceName": query.ServiceName}))
+	// spans ingested before SpanKind column was added have span kind only in span.kind tag,
+	// services table may have neither of them
+	kustoStmt = kustoStmt.Add(` | extend SpanKind = coalesce(column_ifexists("SpanKind", ""), tostring(column_ifexists("Tags", dynamic(null)).span_kind))`)
+
+	if query.SpanKind != "" {
+		kustoStmt = kustoStmt.Add(` | where SpanKind == ParamSpanKind`)
+		kustoDefinitions["ParamSpanKind"] = kusto.ParamType{Type: types.String}
+		kustoParameters["ParamSpanKind"] = query.SpanKind
 	}
 
+	kustoStmt = kustoStmt.Add(`
+| summarize count() by OperationName, SpanKind
+| sort by count_
+| project-away count_`)
+
+	kustoStmt = kustoStmt.MustDefinitions(kusto.NewDefinitions().Must(kustoDefinitions)).MustParameters(kusto.NewParameters().Must(kustoParameters))
+
 	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
 		return nil, err
@@ -176,60 +186,11 @@ func (r *kustoSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.Tra
 		TraceID string `kusto:"TraceID"`
 	}
 
-	kustoStmt := kusto.NewStmt("Spans", kusto.UnsafeStmt(safetySwitch))
-	kustoDefinitions := make(kusto.ParamTypes)
-	kustoParameters := make(kusto.QueryValues)
-
-	if query.ServiceName != "" {
-		kustoStmt = kustoStmt.Add(` | where ProcessServiceName == ParamProcessServiceName`)
-		kustoDefinitions["ParamProcessServiceName"] = kusto.ParamType{Type: types.String}
-		kustoParameters["ParamProcessServiceName"] = query.ServiceName
-	}
-
-	if query.OperationName != "" {
-		kustoStmt = kustoStmt.Add(` | where OperationName == ParamOperationName`)
-		kustoDefinitions["ParamOperationName"] = kusto.ParamType{Type: types.String}
-		kustoParameters["ParamOperationName"] = query.OperationName
-	}
-
-	if query.Tags != nil {
-		for k, v := range query.Tags {
-			replacedTag := strings.ReplaceAll(k, ".", TagDotReplacementCharacter)
-			tagFilter := fmt.Sprintf(" | where Tags.%s == '%s' or ProcessTags.%s == '%s'", replacedTag, v, replacedTag, v)
-			kustoStmt = kustoStmt.UnsafeAdd(tagFilter)
-		}
-	}
-
-	kustoStmt = kustoStmt.Add(` | where StartTime > ParamStartTimeMin`)
-	kustoDefinitions["ParamStartTimeMin"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMin"] = query.StartTimeMin
-
-	kustoStmt = kustoStmt.Add(` | where StartTime < ParamStartTimeMax`)
-	kustoDefinitions["ParamStartTimeMax"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMax"] = query.StartTimeMax
-
-	if query.DurationMin != 0 {
-		kustoStmt = kustoStmt.Add(` | where Duration > ParamDurationMin`)
-		kustoDefinitions["ParamDurationMin"] = kusto.ParamType{Type: types.Timespan}
-		kustoParameters["ParamDurationMin"] = query.DurationMin
-	}
-
-	if query.DurationMax != 0 {
-		kustoStmt = kustoStmt.Add(` | where Duration > ParamDurationMax`)
-		kustoDefinitions["ParamDurationMax"] = kusto.ParamType{Type: types.Timespan}
-		kustoParameters["ParamDurationMax"] = query.DurationMax
-	}
-
-	kustoStmt = kustoStmt.Add("| summarize by TraceID")
-
-	if query.NumTraces != 0 {
-		kustoStmt.Add(`| sample ParamNumTraces`)
-		kustoDefinitions["ParamNumTraces"] = kusto.ParamType{Type: types.Int}
-		kustoParameters["ParamNumTraces"] = int32(query.NumTraces)
+	kustoStmt, err := r.traceQuery(query, false)
+	if err != nil {
+		return nil, err
 	}
 
-	kustoStmt = kustoStmt.MustDefinitions(kusto.NewDefinitions().Must(kustoDefinitions)).MustParameters(kusto.NewParameters().Must(kustoParameters))
-
 	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
 		return nil, err
@@ -261,74 +222,11 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 		return nil, err
 	}
 
-	if query.NumTraces == 0 {
-		query.NumTraces = defaultNumTraces
-	}
-
-	kustoStmt := kusto.NewStmt("let TraceIDs = (Spans", kusto.UnsafeStmt(safetySwitch))
-	kustoDefinitions := make(kusto.ParamTypes)
-	kustoParameters := make(kusto.QueryValues)
-
-	if query.ServiceName != "" {
-		kustoStmt = kustoStmt.Add(` | where ProcessServiceName == ParamProcessServiceName`)
-		kustoDefinitions["ParamProcessServiceName"] = kusto.ParamType{Type: types.String}
-		kustoParameters["ParamProcessServiceName"] = query.ServiceName
-	}
-
-	if query.OperationName != "" {
-		kustoStmt = kustoStmt.Add(` | where OperationName == ParamOperationName`)
-		kustoDefinitions["ParamOperationName"] = kusto.ParamType{Type: types.String}
-		kustoParameters["ParamOperationName"] = query.OperationName
-	}
-
-	if query.Tags != nil {
-		for k, v := range query.Tags {
-			replacedTag := strings.ReplaceAll(k, ".", TagDotReplacementCharacter)
-			tagFilter := fmt.Sprintf(" | where Tags.%s == '%s' or ProcessTags.%s == '%s'", replacedTag, v, replacedTag, v)
-			kustoStmt = kustoStmt.UnsafeAdd(tagFilter)
-		}
-	}
-
-	kustoStmt = kustoStmt.Add(` | where StartTime > ParamStartTimeMin`)
-	kustoDefinitions["ParamStartTimeMin"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMin"] = query.StartTimeMin
-
-	kustoStmt = kustoStmt.Add(` | where StartTime < ParamStartTimeMax`)
-	kustoDefinitions["ParamStartTimeMax"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMax"] = query.StartTimeMax
-
-	if query.DurationMin != 0 {
-		kustoStmt = kustoStmt.Add(` | where Duration > ParamDurationMin`)
-		kustoDefinitions["ParamDurationMin"] = kusto.ParamType{Type: types.Timespan}
-		kustoParameters["ParamDurationMin"] = query.DurationMin
-	}
-
-	if query.DurationMax != 0 {
-		kustoStmt = kustoStmt.Add(` | where Duration > ParamDurationMax`)
-		kustoDefinitions["ParamDurationMax"] = kusto.ParamType{Type: types.Timespan}
-		kustoParameters["ParamDurationMax"] = query.DurationMax
+	kustoStmt, err := r.traceQuery(query, true)
+	if err != nil {
+		return nil, err
 	}
 
-	kustoStmt = kustoStmt.Add(" | summarize by TraceID")
-
-	kustoStmt = kustoStmt.Add(` | sample ParamNumTraces`)
-	kustoDefinitions["ParamNumTraces"] = kusto.ParamType{Type: types.Int}
-	kustoParameters["ParamNumTraces"] = int32(query.NumTraces)
-
-	kustoStmt = kustoStmt.Add("); Spans")
-
-	kustoStmt = kustoStmt.Add(` | where StartTime > ParamStartTimeMin`)
-	kustoDefinitions["ParamStartTimeMin"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMin"] = query.StartTimeMin
-
-	kustoStmt = kustoStmt.Add(` | where StartTime < ParamStartTimeMax`)
-	kustoDefinitions["ParamStartTimeMax"] = kusto.ParamType{Type: types.DateTime}
-	kustoParameters["ParamStartTimeMax"] = query.StartTimeMax
-
-	kustoStmt = kustoStmt.Add(` | where TraceID in (TraceIDs)`)
-
-	kustoStmt = kustoStmt.MustDefinitions(kusto.NewDefinitions().Must(kustoDefinitions)).MustParameters(kusto.NewParameters().Must(kustoParameters))
-
 	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
 		return nil, err
@@ -368,27 +266,41 @@ func (r *kustoSpanReader) FindTraces(ctx context.Context, query *spanstore.Trace
 
 // GetDependencies returns DependencyLinks of services
 func (r *kustoSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	type kustoDependencyLink struct {
-		Parent    string     `kusto:"Parent"`
-		Child     string     `kusto:"Child"`
-		CallCount value.Long `kusto:"CallCount"`
+	if r.tables.Dependencies != "" {
+		// dependencies table contains calls aggregated by hour, see dependenciesJob.
+		// Marker rows are summarized into edge without services, which is not a call
+		edges, err := r.queryDependencyEdges(ctx, kusto.NewStmt(`table(ParamTable)
+| where Timestamp >= bin(ParamEndTs-ParamLookBack, 1h) and Timestamp < ParamEndTs
+| summarize CallCount = sum(CallCount) by Parent, ParentKind, Child, ChildKind`), r.tables.Dependencies, endTs, lookback)
+		if err != nil {
+			return nil, err
+		}
+		if hasDependenciesMarker(edges) {
+			return dependencyLinks(edges, r.dependencySpanKinds), nil
+		}
+		r.logger.Debug("No aggregated dependencies in requested range, computing them from spans", "table", r.tables.Dependencies)
 	}
 
-	kustoStmt := kusto.NewStmt(`Spans
+	edges, err := r.queryDependencyEdges(ctx, kusto.NewStmt(`let Spans = table(ParamTable)
 | where StartTime < ParamEndTs and StartTime > (ParamEndTs-ParamLookBack)
-| project ProcessServiceName, SpanID, ChildOfSpanId = tostring(References[0].spanID)
-| join (Spans | project ChildOfSpanId=SpanID, ParentService=ProcessServiceName) on ChildOfSpanId
-| where ProcessServiceName != ParentService
-| extend Call=pack('Parent', ParentService, 'Child', ProcessServiceName)
-| summarize CallCount=count() by tostring(Call)
-| extend Call=parse_json(Call)
-| evaluate bag_unpack(Call)`).MustDefinitions(
+| extend SpanKind = coalesce(column_ifexists("SpanKind", ""), tostring(Tags.span_kind));
+let Children = Spans;`).Add(dependencyEdgesQuery), r.tables.Spans, endTs, lookback)
+	if err != nil {
+		return nil, err
+	}
+
+	return dependencyLinks(edges, r.dependencySpanKinds), nil
+}
+
+func (r *kustoSpanReader) queryDependencyEdges(ctx context.Context, kustoStmt kusto.Stmt, tableName string, endTs time.Time, lookback time.Duration) ([]dependencyEdge, error) {
+	kustoStmt = kustoStmt.MustDefinitions(
 		kusto.NewDefinitions().Must(
 			kusto.ParamTypes{
+				"ParamTable":    kusto.ParamType{Type: types.String},
 				"ParamEndTs":    kusto.ParamType{Type: types.DateTime},
 				"ParamLookBack": kusto.ParamType{Type: types.Timespan},
 			},
-		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamEndTs": endTs, "ParamLookBack": lookback}))
+		)).MustParameters(kusto.NewParameters().Must(kusto.QueryValues{"ParamTable": tableName, "ParamEndTs": endTs, "ParamLookBack": lookback}))
 
 	iter, err := r.client.Query(ctx, r.database, kustoStmt)
 	if err != nil {
@@ -396,22 +308,17 @@ func (r *kustoSpanReader) GetDependencies(ctx context.Context, endTs time.Time,
 	}
 	defer iter.Stop()
 
-	var dependencyLinks []model.DependencyLink
+	var edges []dependencyEdge
 	err = iter.Do(
 		func(row *table.Row) error {
-			rec := kustoDependencyLink{}
+			rec := dependencyEdge{}
 			if err := row.ToStruct(&rec); err != nil {
 				return err
 			}
-
-			dependencyLinks = append(dependencyLinks, model.DependencyLink{
-				Parent:    rec.Parent,
-				Child:     rec.Child,
-				CallCount: uint64(rec.CallCount.Value),
-			})
+			edges = append(edges, rec)
 			return nil
 		},
 	)
 
-	return dependencyLinks, err
+	return edges, err
 }
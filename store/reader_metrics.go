@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// metricsSpanReader records duration and errors of kustoSpanReader queries by method
+type metricsSpanReader struct {
+	reader *kustoSpanReader
+	table  string
+}
+
+func newMetricsSpanReader(reader *kustoSpanReader) *metricsSpanReader {
+	return &metricsSpanReader{reader: reader, table: reader.tables.Spans}
+}
+
+// GetTrace finds trace by TraceID
+func (r *metricsSpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	start := time.Now()
+	trace, err := r.reader.GetTrace(ctx, traceID)
+	observeQuery(r.table, "GetTrace", start, err)
+	return trace, err
+}
+
+// GetServices finds all possible services that spanstore contains
+func (r *metricsSpanReader) GetServices(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	services, err := r.reader.GetServices(ctx)
+	observeQuery(r.table, "GetServices", start, err)
+	return services, err
+}
+
+// GetOperations finds all operations by provided Service and SpanKind
+func (r *metricsSpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	start := time.Now()
+	operations, err := r.reader.GetOperations(ctx, query)
+	observeQuery(r.table, "GetOperations", start, err)
+	return operations, err
+}
+
+// FindTraceIDs finds TraceIDs by provided query
+func (r *metricsSpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	start := time.Now()
+	traceIDs, err := r.reader.FindTraceIDs(ctx, query)
+	observeQuery(r.table, "FindTraceIDs", start, err)
+	return traceIDs, err
+}
+
+// FindTraces finds and returns full traces with spans
+func (r *metricsSpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	start := time.Now()
+	traces, err := r.reader.FindTraces(ctx, query)
+	observeQuery(r.table, "FindTraces", start, err)
+	return traces, err
+}
+
+// GetDependencies returns DependencyLinks of services
+func (r *metricsSpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	start := time.Now()
+	dependencyLinks, err := r.reader.GetDependencies(ctx, endTs, lookback)
+	observeQuery(r.table, "GetDependencies", start, err)
+	return dependencyLinks, err
+}
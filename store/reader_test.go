@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+var errQueryCaptured = errors.New("query captured")
+
+// fakeReaderClient captures query statement and fails query, so reader returns without reading rows
+type fakeReaderClient struct {
+	stmt kusto.Stmt
+}
+
+func (c *fakeReaderClient) Query(_ context.Context, _ string, query kusto.Stmt, _ ...kusto.QueryOption) (*kusto.RowIterator, error) {
+	c.stmt = query
+	return nil, errQueryCaptured
+}
+
+func newTestSpanReader(client kustoReaderClient) *kustoSpanReader {
+	return &kustoSpanReader{
+		client:   client,
+		database: "Database",
+		tables:   &kustoTables{Spans: "Spans", Services: "Services"},
+	}
+}
+
+func Test_KustoSpanReader_GetOperations(testing *testing.T) {
+	cases := []struct {
+		name     string
+		query    spanstore.OperationQueryParameters
+		contains []string
+		params   string
+	}{
+		{
+			name:   "all",
+			query:  spanstore.OperationQueryParameters{},
+			params: `{"ParamTable":"Services"}`,
+		},
+		{
+			name:     "service",
+			query:    spanstore.OperationQueryParameters{ServiceName: "frontend"},
+			contains: []string{"where ProcessServiceName == ParamProcessServiceName"},
+			params:   `{"ParamProcessServiceName":"frontend","ParamTable":"Services"}`,
+		},
+		{
+			name:     "kind",
+			query:    spanstore.OperationQueryParameters{SpanKind: "server"},
+			contains: []string{"where SpanKind == ParamSpanKind"},
+			params:   `{"ParamSpanKind":"server","ParamTable":"Services"}`,
+		},
+		{
+			name:     "service and kind",
+			query:    spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "client"},
+			contains: []string{"where ProcessServiceName == ParamProcessServiceName", "where SpanKind == ParamSpanKind"},
+			params:   `{"ParamProcessServiceName":"frontend","ParamSpanKind":"client","ParamTable":"Services"}`,
+		},
+	}
+
+	for _, c := range cases {
+		client := &fakeReaderClient{}
+		reader := newTestSpanReader(client)
+
+		_, err := reader.GetOperations(context.Background(), c.query)
+		assert.Equal(testing, errQueryCaptured, err)
+
+		query := client.stmt.String()
+		assert.Contains(testing, query, "summarize count() by OperationName, SpanKind")
+		for _, filter := range c.contains {
+			assert.Contains(testing, query, filter)
+		}
+		if c.query.SpanKind == "" {
+			assert.NotContains(testing, query, "ParamSpanKind")
+		}
+
+		params, err := client.stmt.ValuesJSON()
+		assert.NoError(testing, err)
+		assert.JSONEq(testing, c.params, params)
+	}
+}
+
+func Test_KustoSpanReader_FindTraces_Tags(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName: "frontend",
+		Tags: map[string]string{
+			"http.url": "/'; Spans | take 1 //",
+			"error":    "true",
+		},
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	cases := []struct {
+		name string
+		find func(reader *kustoSpanReader) error
+	}{
+		{
+			name: "FindTraceIDs",
+			find: func(reader *kustoSpanReader) error {
+				_, err := reader.FindTraceIDs(context.Background(), query)
+				return err
+			},
+		},
+		{
+			name: "FindTraces",
+			find: func(reader *kustoSpanReader) error {
+				_, err := reader.FindTraces(context.Background(), query)
+				return err
+			},
+		},
+	}
+
+	for _, c := range cases {
+		client := &fakeReaderClient{}
+		assert.Equal(testing, errQueryCaptured, c.find(newTestSpanReader(client)))
+
+		stmt := client.stmt.String()
+		assert.Contains(testing, stmt, `where column_ifexists("HasError", false) or tostring(Tags.error) == "true"`)
+		assert.Contains(testing, stmt, tagFiltersQuery)
+		assert.NotContains(testing, stmt, "http")
+		assert.NotContains(testing, stmt, "take 1")
+
+		params, err := client.stmt.ValuesJSON()
+		assert.NoError(testing, err)
+		assert.Contains(testing, params, `"ParamTags":"dynamic([{\"name\":\"http.url\",\"key\":\"http_url\",\"path\":[\"http\",\"url\"],\"op\":\"eq\",\"value\":\"/'; Spans | take 1 //\"}])"`)
+	}
+}
+
+func Test_FindTraceIDs_ErrorWithoutHasErrorColumn(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		Tags:         map[string]string{"error": "true"},
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	client := &fakeReaderClient{}
+	_, err := newTestSpanReader(client).FindTraceIDs(context.Background(), query)
+	assert.Equal(testing, errQueryCaptured, err)
+
+	// query on table without HasError column fails if the column is referenced directly
+	stmt := client.stmt.String()
+	assert.Equal(testing, 1, strings.Count(stmt, "HasError"))
+	assert.Contains(testing, stmt, `column_ifexists("HasError", false)`)
+}
+
+func Test_KustoSpanReader_FindTraceIDs_LogFieldsQuery(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		Tags:         map[string]string{"http.status_code": ">=500"},
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	client := &fakeReaderClient{}
+	reader := newTestSpanReader(client)
+	reader.searchLogs = true
+
+	_, err := reader.FindTraceIDs(context.Background(), query)
+	assert.Equal(testing, errQueryCaptured, err)
+
+	stmt := client.stmt.String()
+	assert.Contains(testing, stmt, "| mv-apply LogEntry = array_concat(coalesce(Logs, dynamic([])), dynamic([{}])) to typeof(dynamic) on (")
+	assert.Contains(testing, stmt, "mv-expand LogField = LogEntry.fields")
+	assert.NotContains(testing, stmt, "status_code")
+
+	// log fields are looked up by tag name with dots, span tags by key with replaced dots
+	params, err := client.stmt.ValuesJSON()
+	assert.NoError(testing, err)
+	assert.Contains(testing, params, `\"name\":\"http.status_code\",\"key\":\"http_status_code\"`)
+	assert.Contains(testing, params, `\"op\":\"ge\",\"value\":\"500\"`)
+}
+
+func Test_ValidateQuery_TagKey(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	for _, key := range []string{"", "http\nurl"} {
+		query.Tags = map[string]string{key: "value"}
+		assert.Equal(testing, ErrInvalidTagKey, validateQuery(query))
+	}
+
+	query.Tags = map[string]string{"http.url": "value"}
+	assert.NoError(testing, validateQuery(query))
+}
+
+func Test_KustoSpanReader_FindTraceIDs_SearchLogs(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		Tags:         map[string]string{"event": "retry"},
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+	}
+
+	for _, searchLogs := range []bool{false, true} {
+		client := &fakeReaderClient{}
+		reader := newTestSpanReader(client)
+		reader.searchLogs = searchLogs
+
+		_, err := reader.FindTraceIDs(context.Background(), query)
+		assert.Equal(testing, errQueryCaptured, err)
+
+		stmt := client.stmt.String()
+		if searchLogs {
+			assert.Contains(testing, stmt, tagFiltersLogsQuery)
+		} else {
+			assert.Contains(testing, stmt, tagFiltersQuery)
+			assert.NotContains(testing, stmt, "Logs")
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/data/value"
+	"github.com/Azure/azure-kusto-go/kusto/unsafe"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+)
+
+type kustoMgmtClient interface {
+	Mgmt(ctx context.Context, db string, query kusto.Stmt, options ...kusto.MgmtOption) (*kusto.RowIterator, error)
+}
+
+// kustoColumn describes single column of Kusto table
+type kustoColumn struct {
+	Name string
+	Type string
+}
+
+func (c kustoColumn) String() string {
+	return fmt.Sprintf("%s:%s", c.Name, c.Type)
+}
+
+var entityNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-. ]+$`)
+
+// validateEntityName returns error if name of Kusto entity (table, mapping) can't be safely used in commands
+func validateEntityName(name string) error {
+	if !entityNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid kusto entity name %q", name)
+	}
+	return nil
+}
+
+// quoteTableName validates table name and returns it in bracketed form
+func quoteTableName(name string) (string, error) {
+	if err := validateEntityName(name); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("['%s']", name), nil
+}
+
+// kustoSpanColumns returns columns of spans table in the same order as kustoSpan fields
+func kustoSpanColumns() []kustoColumn {
+	spanType := reflect.TypeOf(kustoSpan{})
+
+	columns := make([]kustoColumn, 0, spanType.NumField())
+	for i := 0; i < spanType.NumField(); i++ {
+		field := spanType.Field(i)
+		columns = append(columns, kustoColumn{
+			Name: field.Tag.Get("kusto"),
+			Type: kustoColumnType(field.Type),
+		})
+	}
+
+	return columns
+}
+
+func kustoColumnType(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf(value.Dynamic{}):
+		return "dynamic"
+	case reflect.TypeOf(time.Time{}):
+		return "datetime"
+	case reflect.TypeOf(time.Duration(0)):
+		return "timespan"
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int32:
+		return "int"
+	case reflect.Int64:
+		return "long"
+	case reflect.Float64:
+		return "real"
+	default:
+		return "string"
+	}
+}
+
+// kustoSpanMapping returns ingestion mapping of spans table for provided data format
+func kustoSpanMapping(format string) (string, error) {
+	type mappingColumn struct {
+		Column     string            `json:"column"`
+		Properties map[string]string `json:"Properties"`
+	}
+
+	var mapping []mappingColumn
+	for i, column := range kustoSpanColumns() {
+		properties := map[string]string{}
+		switch format {
+		case "csv":
+			properties["Ordinal"] = fmt.Sprint(i)
+		case "json":
+			properties["Path"] = fmt.Sprintf("$.%s", column.Name)
+		default:
+			return "", fmt.Errorf("unsupported ingestion mapping format %q", format)
+		}
+		mapping = append(mapping, mappingColumn{Column: column.Name, Properties: properties})
+	}
+
+	data, err := json.Marshal(mapping)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// schemaCommands returns management commands, which create spans table with its ingestion mappings and policies
+func schemaCommands(pc *config.PluginConfig, tableName string) ([]string, error) {
+	name, err := quoteTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateEntityName(pc.KustoMappingName); err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for _, column := range kustoSpanColumns() {
+		columns = append(columns, column.String())
+	}
+
+	commands := []string{
+		// merge adds columns, which appeared in new versions of plugin, to existing table
+		fmt.Sprintf(".create-merge table %s (%s)", name, strings.Join(columns, ", ")),
+	}
+
+	for _, format := range []string{"csv", "json"} {
+		mapping, err := kustoSpanMapping(format)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, fmt.Sprintf(".create-or-alter table %s ingestion %s mapping '%s' @'%s'", name, format, pc.KustoMappingName, mapping))
+	}
+
+	if pc.SchemaRetentionDays > 0 {
+		commands = append(commands, fmt.Sprintf(".alter-merge table %s policy retention softdelete = %dd", name, pc.SchemaRetentionDays))
+	}
+	if pc.SchemaCachingDays > 0 {
+		commands = append(commands, fmt.Sprintf(".alter table %s policy caching hot = %dd", name, pc.SchemaCachingDays))
+	}
+	if pc.WriterIngestionMode == config.IngestionModeStreaming {
+		commands = append(commands, fmt.Sprintf(".alter table %s policy streamingingestion enable", name))
+	}
+	if pc.SchemaBatchingTimeoutSeconds > 0 {
+		batching := value.Timespan{Value: time.Duration(pc.SchemaBatchingTimeoutSeconds) * time.Second, Valid: true}.Marshal()
+		commands = append(commands, fmt.Sprintf(`.alter table %s policy ingestionbatching @'{"MaximumBatchingTimeSpan":"%s"}'`, name, batching))
+	}
+
+	return commands, nil
+}
+
+// dependenciesSchemaCommands returns management commands, which create table with dependencies aggregated by hour
+func dependenciesSchemaCommands(pc *config.PluginConfig, tableName string) ([]string, error) {
+	name, err := quoteTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for _, column := range dependenciesColumns {
+		columns = append(columns, column.String())
+	}
+
+	commands := []string{
+		fmt.Sprintf(".create-merge table %s (%s)", name, strings.Join(columns, ", ")),
+	}
+	if pc.SchemaRetentionDays > 0 {
+		commands = append(commands, fmt.Sprintf(".alter-merge table %s policy retention softdelete = %dd", name, pc.SchemaRetentionDays))
+	}
+
+	return commands, nil
+}
+
+// InitSchema creates spans tables, ingestion mappings and policies, then verifies tables schema
+func InitSchema(pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) error {
+	client, err := newKustoClient(kc)
+	if err != nil {
+		return err
+	}
+
+	factory := newKustoFactory(client, pc, kc.Database)
+
+	tables := []string{factory.Tables.Spans}
+	if factory.Tables.Archive != "" {
+		tables = append(tables, factory.Tables.Archive)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	for _, tableName := range tables {
+		commands, err := schemaCommands(pc, tableName)
+		if err != nil {
+			return err
+		}
+
+		for _, command := range commands {
+			logger.Info("executing schema command", "table", tableName, "command", command)
+			if err := execMgmt(ctx, factory.Mgmt(), factory.Database, command); err != nil {
+				return err
+			}
+		}
+
+		if err := verifySchema(ctx, factory.Mgmt(), factory.Database, tableName); err != nil {
+			return err
+		}
+		logger.Info("schema initialized", "table", tableName)
+	}
+
+	if factory.Tables.Dependencies != "" {
+		commands, err := dependenciesSchemaCommands(pc, factory.Tables.Dependencies)
+		if err != nil {
+			return err
+		}
+
+		for _, command := range commands {
+			logger.Info("executing schema command", "table", factory.Tables.Dependencies, "command", command)
+			if err := execMgmt(ctx, factory.Mgmt(), factory.Database, command); err != nil {
+				return err
+			}
+		}
+		logger.Info("schema initialized", "table", factory.Tables.Dependencies)
+	}
+
+	return nil
+}
+
+// safetySwitch allows management commands, which can't take query parameters.
+// Table names are validated by quoteTableName before they are added to commands
+var safetySwitch = unsafe.Stmt{
+	Add:             true,
+	SuppressWarning: true,
+}
+
+func execMgmt(ctx context.Context, client kustoMgmtClient, database, command string) error {
+	kustoStmt := kusto.NewStmt("", kusto.UnsafeStmt(safetySwitch)).UnsafeAdd(command)
+
+	iter, err := client.Mgmt(ctx, database, kustoStmt, kusto.AllowWrite())
+	if err != nil {
+		return err
+	}
+	defer iter.Stop()
+
+	return iter.Do(func(_ *table.Row) error {
+		return nil
+	})
+}
+
+// showTableColumns returns columns of existing table in their order
+func showTableColumns(ctx context.Context, client kustoMgmtClient, database, tableName string) ([]kustoColumn, error) {
+	name, err := quoteTableName(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	kustoStmt := kusto.NewStmt(".show table ", kusto.UnsafeStmt(safetySwitch)).UnsafeAdd(name).Add(" cslschema")
+
+	iter, err := client.Mgmt(ctx, database, kustoStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Stop()
+
+	type tableSchema struct {
+		Schema string `kusto:"Schema"`
+	}
+
+	var columns []kustoColumn
+	err = iter.Do(
+		func(row *table.Row) error {
+			rec := tableSchema{}
+			if err := row.ToStruct(&rec); err != nil {
+				return err
+			}
+			columns = parseCslSchema(rec.Schema)
+			return nil
+		},
+	)
+
+	return columns, err
+}
+
+// parseCslSchema parses table schema in "Name:type, Name:type" form
+func parseCslSchema(schema string) []kustoColumn {
+	var columns []kustoColumn
+	for _, column := range strings.Split(schema, ",") {
+		parts := strings.SplitN(strings.TrimSpace(column), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		columns = append(columns, kustoColumn{
+			Name: strings.TrimSpace(parts[0]),
+			Type: strings.TrimSpace(parts[1]),
+		})
+	}
+	return columns
+}
+
+// schemaDiff describes differences between expected and actual columns of spans table
+type schemaDiff struct {
+	Missing   []kustoColumn
+	Extra     []kustoColumn
+	Mistyped  []string
+	Misplaced []string
+}
+
+func diffSchema(expected, actual []kustoColumn) *schemaDiff {
+	diff := &schemaDiff{}
+
+	actualPositions := make(map[string]int, len(actual))
+	for i, column := range actual {
+		actualPositions[column.Name] = i
+	}
+	expectedPositions := make(map[string]int, len(expected))
+	for i, column := range expected {
+		expectedPositions[column.Name] = i
+	}
+
+	for i, column := range expected {
+		position, ok := actualPositions[column.Name]
+		if !ok {
+			diff.Missing = append(diff.Missing, column)
+			continue
+		}
+		if actual[position].Type != column.Type {
+			diff.Mistyped = append(diff.Mistyped, fmt.Sprintf("%s (expected %s, actual %s)", column.Name, column.Type, actual[position].Type))
+		}
+		if position != i {
+			diff.Misplaced = append(diff.Misplaced, fmt.Sprintf("%s (expected position %d, actual %d)", column.Name, i, position))
+		}
+	}
+
+	for _, column := range actual {
+		if _, ok := expectedPositions[column.Name]; !ok {
+			diff.Extra = append(diff.Extra, column)
+		}
+	}
+
+	return diff
+}
+
+// Empty returns true if there are no differences
+func (d *schemaDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mistyped) == 0 && len(d.Misplaced) == 0
+}
+
+// Breaking returns true if ingested spans would be lost or misaligned, extra columns are just left empty
+func (d *schemaDiff) Breaking() bool {
+	return len(d.Missing) > 0 || len(d.Mistyped) > 0 || len(d.Misplaced) > 0
+}
+
+func (d *schemaDiff) String() string {
+	var parts []string
+	if len(d.Missing) > 0 {
+		parts = append(parts, fmt.Sprintf("missing columns: %v", d.Missing))
+	}
+	if len(d.Extra) > 0 {
+		parts = append(parts, fmt.Sprintf("extra columns: %v", d.Extra))
+	}
+	if len(d.Mistyped) > 0 {
+		parts = append(parts, fmt.Sprintf("mistyped columns: %s", strings.Join(d.Mistyped, ", ")))
+	}
+	if len(d.Misplaced) > 0 {
+		parts = append(parts, fmt.Sprintf("misplaced columns: %s", strings.Join(d.Misplaced, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// compareSchema returns differences between columns of existing table and kustoSpan
+func compareSchema(ctx context.Context, client kustoMgmtClient, database, tableName string) (*schemaDiff, error) {
+	actual, err := showTableColumns(ctx, client, database, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(actual) == 0 {
+		return nil, fmt.Errorf("table %s not found or has no columns", tableName)
+	}
+
+	return diffSchema(kustoSpanColumns(), actual), nil
+}
+
+// verifySchema returns error if columns of existing table not matching kustoSpan
+func verifySchema(ctx context.Context, client kustoMgmtClient, database, tableName string) error {
+	diff, err := compareSchema(ctx, client, database, tableName)
+	if err != nil {
+		return err
+	}
+
+	if !diff.Empty() {
+		return fmt.Errorf("schema of table %s not matching spans schema: %s", tableName, diff)
+	}
+
+	return nil
+}
+
+// validateSchema verifies schema of spans tables and reports mismatch according to configured validation mode
+func validateSchema(factory *kustoFactory, logger hclog.Logger) error {
+	mode := factory.PluginConfig.SchemaValidation
+	if mode == config.SchemaValidationOff {
+		return nil
+	}
+
+	tables := []string{factory.Tables.Spans}
+	if factory.Tables.Archive != "" {
+		tables = append(tables, factory.Tables.Archive)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, tableName := range tables {
+		diff, err := compareSchema(ctx, factory.Mgmt(), factory.Database, tableName)
+		if err != nil {
+			if mode == config.SchemaValidationFail {
+				return err
+			}
+			logger.Warn("schema validation failed", "table", tableName, "error", err)
+			continue
+		}
+		if diff.Empty() {
+			continue
+		}
+		// warn mode tolerates extra columns only, spans written to table with missing or misplaced columns are corrupt
+		if mode == config.SchemaValidationFail || diff.Breaking() {
+			return fmt.Errorf("schema of table %s not matching spans schema, run plugin with -init-schema to migrate it: %s", tableName, diff)
+		}
+		logger.Warn("spans table has extra columns, which are left empty", "table", tableName, "difference", diff.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseCslSchema(testing *testing.T) {
+	columns := parseCslSchema("TraceID:string, Flags:int,Duration:timespan")
+
+	assert.Equal(testing, []kustoColumn{
+		{Name: "TraceID", Type: "string"},
+		{Name: "Flags", Type: "int"},
+		{Name: "Duration", Type: "timespan"},
+	}, columns)
+}
+
+func Test_DiffSchema_Equal(testing *testing.T) {
+	diff := diffSchema(kustoSpanColumns(), kustoSpanColumns())
+
+	assert.True(testing, diff.Empty())
+}
+
+func Test_DiffSchema(testing *testing.T) {
+	expected := []kustoColumn{
+		{Name: "TraceID", Type: "string"},
+		{Name: "SpanID", Type: "string"},
+		{Name: "Flags", Type: "int"},
+		{Name: "Duration", Type: "timespan"},
+	}
+	actual := []kustoColumn{
+		{Name: "SpanID", Type: "string"},
+		{Name: "TraceID", Type: "string"},
+		{Name: "Flags", Type: "long"},
+		{Name: "Custom", Type: "dynamic"},
+	}
+
+	diff := diffSchema(expected, actual)
+
+	assert.False(testing, diff.Empty())
+	assert.Equal(testing, []kustoColumn{{Name: "Duration", Type: "timespan"}}, diff.Missing)
+	assert.Equal(testing, []kustoColumn{{Name: "Custom", Type: "dynamic"}}, diff.Extra)
+	assert.Equal(testing, []string{"Flags (expected int, actual long)"}, diff.Mistyped)
+	assert.Equal(testing, []string{
+		"TraceID (expected position 0, actual 1)",
+		"SpanID (expected position 1, actual 0)",
+	}, diff.Misplaced)
+}
+
+func Test_TransformSpanToStringArray_MatchesColumns(testing *testing.T) {
+	span := &model.Span{
+		TraceID:       model.NewTraceID(0, 1),
+		SpanID:        model.NewSpanID(2),
+		OperationName: "operation",
+		StartTime:     time.Date(2020, time.June, 10, 13, 0, 0, 0, time.UTC),
+		Duration:      time.Second,
+		Process:       &model.Process{ServiceName: "service"},
+		ProcessID:     "process",
+		References: []model.SpanRef{
+			model.NewFollowsFromRef(model.NewTraceID(0, 1), model.NewSpanID(3)),
+			model.NewChildOfRef(model.NewTraceID(0, 1), model.NewSpanID(4)),
+		},
+		Tags: []model.KeyValue{
+			model.String("span.kind", "server"),
+			model.String("otel.status_code", "ERROR"),
+		},
+	}
+
+	values, err := TransformSpanToStringArray(span)
+	assert.NoError(testing, err)
+
+	columns := kustoSpanColumns()
+	assert.Len(testing, values, len(columns))
+
+	row := make(map[string]string, len(columns))
+	for i, column := range columns {
+		row[column.Name] = values[i]
+	}
+	assert.Equal(testing, span.TraceID.String(), row["TraceID"])
+	assert.Equal(testing, span.SpanID.String(), row["SpanID"])
+	assert.Equal(testing, "operation", row["OperationName"])
+	assert.Equal(testing, "2020-06-10T13:00:00Z", row["StartTime"])
+	assert.Equal(testing, "00:00:01", row["Duration"])
+	assert.Equal(testing, "service", row["ProcessServiceName"])
+	assert.Equal(testing, "process", row["ProcessID"])
+	assert.Equal(testing, "server", row["SpanKind"])
+	assert.Equal(testing, "true", row["HasError"])
+	assert.Equal(testing, "ERROR", row["StatusCode"])
+	assert.Equal(testing, model.NewSpanID(4).String(), row["ParentSpanID"])
+}
+
+func Test_SpanStatus(testing *testing.T) {
+	cases := []struct {
+		name       string
+		tags       []model.KeyValue
+		statusCode string
+		hasError   bool
+	}{
+		{"no tags", nil, "", false},
+		{"error tag", []model.KeyValue{model.Bool("error", true)}, "", true},
+		{"error tag false", []model.KeyValue{model.Bool("error", false)}, "", false},
+		{"status ok", []model.KeyValue{model.String("otel.status_code", "OK")}, "OK", false},
+		{"status error", []model.KeyValue{model.String("otel.status_code", "ERROR")}, "ERROR", true},
+	}
+
+	for _, c := range cases {
+		statusCode, hasError := spanStatus(&model.Span{Tags: c.tags})
+
+		assert.Equal(testing, c.statusCode, statusCode)
+		assert.Equal(testing, c.hasError, hasError)
+	}
+}
+
+func Test_SchemaDiff_Breaking(testing *testing.T) {
+	expected := []kustoColumn{
+		{Name: "TraceID", Type: "string"},
+		{Name: "SpanID", Type: "string"},
+	}
+
+	cases := []struct {
+		actual   []kustoColumn
+		breaking bool
+	}{
+		{[]kustoColumn{{Name: "TraceID", Type: "string"}, {Name: "SpanID", Type: "string"}, {Name: "Custom", Type: "dynamic"}}, false},
+		{[]kustoColumn{{Name: "TraceID", Type: "string"}}, true},
+		{[]kustoColumn{{Name: "TraceID", Type: "string"}, {Name: "SpanID", Type: "long"}}, true},
+		{[]kustoColumn{{Name: "SpanID", Type: "string"}, {Name: "TraceID", Type: "string"}}, true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(testing, c.breaking, diffSchema(expected, c.actual).Breaking(), "%v", c.actual)
+	}
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/hashicorp/go-hclog"
+)
+
+// Results of queued ingestion reported by Kusto
+const (
+	ingestionResultSucceeded = "succeeded"
+	ingestionResultFailed    = "failed"
+	ingestionResultUnknown   = "unknown"
+)
+
+// ingestionStatusTracker waits for results of queued ingestions, which are reported by Kusto to status table,
+// and reports batches rejected by Kusto after they were queued
+type ingestionStatusTracker struct {
+	failedBatches int64 // accessed atomically, first field to be 64-bit aligned
+	table         string
+	timeout       time.Duration
+	logger        hclog.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+func newIngestionStatusTracker(table string, timeout time.Duration, logger hclog.Logger) *ingestionStatusTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ingestionStatusTracker{
+		table:   table,
+		timeout: timeout,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Track waits for ingestion result in background. Wait is result.Wait of queued ingestion
+func (t *ingestionStatusTracker) Track(wait func(ctx context.Context) chan error, batchSize int) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+		defer cancel()
+
+		t.report(<-wait(ctx), batchSize)
+	}()
+}
+
+func (t *ingestionStatusTracker) report(err error, batchSize int) {
+	if err == nil {
+		writerIngestionResults.WithLabelValues(t.table, ingestionResultSucceeded).Inc()
+		atomic.StoreInt64(&t.failedBatches, 0)
+		return
+	}
+
+	// transient failure means status couldn't be retrieved in time, batch may still be ingested
+	if ingest.IsRetryable(err) {
+		writerIngestionResults.WithLabelValues(t.table, ingestionResultUnknown).Inc()
+		t.logger.Warn("Failed to retrieve ingestion status", "batchSize", batchSize, "error", err)
+		return
+	}
+
+	writerIngestionResults.WithLabelValues(t.table, ingestionResultFailed).Inc()
+	atomic.AddInt64(&t.failedBatches, 1)
+
+	status, _ := ingest.GetIngestionStatus(err)
+	t.logger.Error("Kusto rejected ingested batch", "batchSize", batchSize, "status", status, "reason", err)
+}
+
+// FailedBatches returns number of consecutive queued batches, which were rejected by Kusto
+func (t *ingestionStatusTracker) FailedBatches() int64 {
+	return atomic.LoadInt64(&t.failedBatches)
+}
+
+// Close stops waiting for ingestion results
+func (t *ingestionStatusTracker) Close() {
+	t.cancel()
+	t.wg.Wait()
+}
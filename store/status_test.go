@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IngestionStatusTracker(testing *testing.T) {
+	table := "Test_IngestionStatusTracker"
+	tracker := newIngestionStatusTracker(table, time.Second, hclog.NewNullLogger())
+
+	wait := func(err error) func(ctx context.Context) chan error {
+		return func(_ context.Context) chan error {
+			ch := make(chan error, 1)
+			if err != nil {
+				ch <- err
+			}
+			close(ch)
+			return ch
+		}
+	}
+
+	tracker.Track(wait(errors.New("mapping not found")), 10)
+	tracker.Track(wait(errors.New("stream format mismatch")), 10)
+	tracker.Close()
+	assert.Equal(testing, int64(2), tracker.FailedBatches())
+
+	tracker = newIngestionStatusTracker(table, time.Second, hclog.NewNullLogger())
+	tracker.Track(wait(nil), 10)
+	tracker.Close()
+	assert.Equal(testing, int64(0), tracker.FailedBatches())
+
+	assert.Equal(testing, 2.0, testutil.ToFloat64(writerIngestionResults.WithLabelValues(table, ingestionResultFailed)))
+	assert.Equal(testing, 1.0, testutil.ToFloat64(writerIngestionResults.WithLabelValues(table, ingestionResultSucceeded)))
+}
+
+func Test_IngestionStatusTracker_Close(testing *testing.T) {
+	tracker := newIngestionStatusTracker("Spans", time.Hour, hclog.NewNullLogger())
+
+	tracker.Track(func(ctx context.Context) chan error {
+		ch := make(chan error)
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+		return ch
+	}, 10)
+
+	tracker.Close()
+	assert.Equal(testing, int64(0), tracker.FailedBatches())
+}
@@ -1,8 +1,9 @@
 package store
 
 import (
-	"github.com/Azure/azure-kusto-go/kusto"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"errors"
+	"sync"
+
 	"github.com/dodopizza/jaeger-kusto/config"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
@@ -14,25 +15,34 @@ type store struct {
 	dependencyStoreReader dependencystore.Reader
 	reader                spanstore.Reader
 	writer                spanstore.Writer
+	archiveReader         spanstore.Reader
+	archiveWriter         spanstore.Writer
+	client                *kustoClient
+	kustoConfig           *config.KustoConfig
+	writers               []*kustoSpanWriter
+	dependencies          *dependenciesJob
+	readinessFailures     int64
+	reloadMu              sync.Mutex
+}
+
+// Reloader is implemented by storage, which can apply changed configuration without restart
+type Reloader interface {
+	Reload(pc *config.PluginConfig, kc *config.KustoConfig) error
 }
 
 // NewStore creates new Kusto store for Jaeger span storage
 func NewStore(pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logger) (shared.StoragePlugin, error) {
-	authorizer := kusto.Authorization{
-		Config: auth.NewClientCredentialsConfig(
-			kc.ClientID,
-			kc.ClientSecret,
-			kc.TenantID,
-		),
-	}
-
-	client, err := kusto.New(kc.Endpoint, authorizer)
+	client, err := newKustoClient(kc)
 	if err != nil {
 		return nil, err
 	}
 
 	factory := newKustoFactory(client, pc, kc.Database)
 
+	if err := validateSchema(factory, logger); err != nil {
+		return nil, err
+	}
+
 	reader, err := newKustoSpanReader(factory, logger)
 	if err != nil {
 		return nil, err
@@ -43,15 +53,89 @@ func NewStore(pc *config.PluginConfig, kc *config.KustoConfig, logger hclog.Logg
 		return nil, err
 	}
 
+	instrumentedReader := newMetricsSpanReader(reader)
+
 	store := &store{
-		dependencyStoreReader: reader,
-		reader:                reader,
+		dependencyStoreReader: instrumentedReader,
+		reader:                instrumentedReader,
 		writer:                writer,
+		client:                client,
+		kustoConfig:           kc,
+		writers:               []*kustoSpanWriter{writer},
+		readinessFailures:     int64(pc.DiagnosticsReadinessFailures),
+	}
+
+	if factory.Tables.Archive != "" {
+		archiveFactory := factory.Archive()
+
+		archiveReader, err := newKustoSpanReader(archiveFactory, logger)
+		if err != nil {
+			return nil, err
+		}
+		store.archiveReader = newMetricsSpanReader(archiveReader)
+
+		archiveWriter, err := newKustoSpanWriter(archiveFactory, logger)
+		if err != nil {
+			return nil, err
+		}
+		store.archiveWriter = archiveWriter
+		store.writers = append(store.writers, archiveWriter)
+	}
+
+	if pc.WriterDependenciesEnabled {
+		store.dependencies = newDependenciesJob(factory, logger)
+		go store.dependencies.Run()
 	}
 
 	return store, nil
 }
 
+// Reload applies changed configuration: replaces Kusto client, when credentials or endpoint changed,
+// and resizes writers batching and workers. Other options require restart
+func (store *store) Reload(pc *config.PluginConfig, kc *config.KustoConfig) error {
+	store.reloadMu.Lock()
+	defer store.reloadMu.Unlock()
+
+	if kc.Database != store.kustoConfig.Database {
+		return errors.New("changing database requires restart")
+	}
+
+	if *kc != *store.kustoConfig {
+		if err := store.client.Reload(kc); err != nil {
+			return err
+		}
+		store.kustoConfig = kc
+
+		// streaming connection holds authorization of client, which it was created with
+		for _, writer := range store.writers {
+			if err := writer.ResetIngest(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, writer := range store.writers {
+		writer.Reconfigure(pc)
+	}
+
+	return nil
+}
+
+// Close stops dependencies job and flushes spans of writers
+func (store *store) Close() error {
+	if store.dependencies != nil {
+		store.dependencies.Close()
+	}
+
+	var err error
+	for _, writer := range store.writers {
+		if closeErr := writer.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // DependencyReader returns implementation of dependencystore.Reader interface
 func (store *store) DependencyReader() dependencystore.Reader {
 	return store.dependencyStoreReader
@@ -66,3 +150,13 @@ func (store *store) SpanReader() spanstore.Reader {
 func (store *store) SpanWriter() spanstore.Writer {
 	return store.writer
 }
+
+// ArchiveSpanReader returns implementation of spanstore.Reader interface for archived spans
+func (store *store) ArchiveSpanReader() spanstore.Reader {
+	return store.archiveReader
+}
+
+// ArchiveSpanWriter returns implementation of spanstore.Writer interface for archived spans
+func (store *store) ArchiveSpanWriter() spanstore.Writer {
+	return store.archiveWriter
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+)
+
+// tagFiltersQuery keeps spans, which have all tags from ParamTags in span or process tags.
+// Tag keys and values are passed as dynamic parameter, so they are never interpolated into query.
+// Tag is looked up by key flattened as dbmodel stores it, then by path of nested objects (up to 3 levels).
+// Value matches stringified tag, or typed tag when filter value is a number or a boolean
+const tagFiltersQuery = tagFiltersApply + tagValues + tagFiltersMatch
+
+// tagFiltersLogsQuery keeps spans, which have all tags from ParamTags in span or process tags, or in fields of logs.
+// Log fields are collected to KeyValues bag of values by key. Empty log entry is always added,
+// so spans without logs are kept by mv-apply and matched by their tags
+const tagFiltersLogsQuery = ` | mv-apply LogEntry = array_concat(coalesce(Logs, dynamic([])), dynamic([{}])) to typeof(dynamic) on (
+    mv-expand LogField = LogEntry.fields to typeof(dynamic)
+    | summarize LogValues = make_list(LogField.value) by LogKey = tostring(LogField.key)
+    | summarize KeyValues = make_bag(bag_pack(LogKey, LogValues)))` +
+	tagFiltersApply + `array_concat(` + tagValues + `, coalesce(KeyValues[tostring(TagFilter.name)], dynamic([])))` + tagFiltersMatch + `, KeyValues`
+
+const (
+	tagFiltersApply = ` | mv-apply with_itemindex = TagFilterIndex TagFilter = ParamTags to typeof(dynamic) on (
+    extend TagKey = tostring(TagFilter.key), TagPath0 = tostring(TagFilter.path[0]), TagPath1 = tostring(TagFilter.path[1]), TagPath2 = tostring(TagFilter.path[2])
+    | extend TagValue = `
+
+	// deepest path goes first, as shallower path of nested tag holds object, which isn't null.
+	// Path element missing in filter is empty, so deeper lookup of shorter path is null
+	tagValues = `pack_array(
+        coalesce(Tags[TagKey], Tags[TagPath0][TagPath1][TagPath2], Tags[TagPath0][TagPath1]),
+        coalesce(ProcessTags[TagKey], ProcessTags[TagPath0][TagPath1][TagPath2], ProcessTags[TagPath0][TagPath1]))`
+
+	// filter matches, when any found value satisfies its operator, except not equal filter,
+	// which matches when tag is found and none of its values is equal.
+	// Substring is matched by contains, not has: has matches whole terms only (*ome* wouldn't find home),
+	// and its term index speedup doesn't apply to values taken out of dynamic columns, so both scan values.
+	// Regular expressions must be constants, so they are passed as separate parameters by slot
+	tagFiltersMatch = `
+    | mv-expand TagValue to typeof(dynamic)
+    | where isnotnull(TagValue)
+    | extend TagOp = tostring(TagFilter.op), TagText = tostring(TagValue), TagNumber = todouble(TagValue), FilterNumber = todouble(TagFilter.number)
+    | extend TagEqual = TagText == tostring(TagFilter.value)
+        or (isnotnull(FilterNumber) and TagNumber == FilterNumber)
+        or (isnotnull(TagFilter.bool) and tobool(TagValue) == tobool(TagFilter.bool))
+    | summarize TagEquals = countif(TagEqual), TagMatches = countif(case(
+        TagOp == "contains", TagText contains tostring(TagFilter.value),
+        TagOp == "gt", TagNumber > FilterNumber,
+        TagOp == "ge", TagNumber >= FilterNumber,
+        TagOp == "lt", TagNumber < FilterNumber,
+        TagOp == "le", TagNumber <= FilterNumber,
+        TagOp == "regex", (TagFilter.regex == 0 and TagText matches regex ParamTagRegex0)
+            or (TagFilter.regex == 1 and TagText matches regex ParamTagRegex1)
+            or (TagFilter.regex == 2 and TagText matches regex ParamTagRegex2),
+        TagEqual))
+        by TagFilterIndex, TagOp
+    | summarize MatchedTags = countif(iff(TagOp == "ne", TagEquals == 0, TagMatches > 0)))
+| where MatchedTags == array_length(ParamTags)
+| project-away MatchedTags`
+)
+
+// Operators of tag filters, set by prefix of tag value in query
+const (
+	tagOpEqual          = "eq"
+	tagOpNotEqual       = "ne"
+	tagOpContains       = "contains"
+	tagOpRegex          = "regex"
+	tagOpGreater        = "gt"
+	tagOpGreaterOrEqual = "ge"
+	tagOpLess           = "lt"
+	tagOpLessOrEqual    = "le"
+)
+
+const (
+	// maxTagRegexes is number of ParamTagRegex parameters referenced by tagFiltersMatch
+	maxTagRegexes = 3
+	// maxTagRegexLength limits length of regular expression in tag value
+	maxTagRegexLength = 256
+)
+
+// tagRegexParameters are names of parameters holding regular expressions of tag filters by slot
+var tagRegexParameters = [maxTagRegexes]string{"ParamTagRegex0", "ParamTagRegex1", "ParamTagRegex2"}
+
+// tagFilter is single tag condition of trace query, passed to Kusto as element of ParamTags
+type tagFilter struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Path   []string `json:"path,omitempty"`
+	Op     string   `json:"op"`
+	Value  string   `json:"value"`
+	Number *float64 `json:"number,omitempty"`
+	Bool   *bool    `json:"bool,omitempty"`
+	Regex  *int     `json:"regex,omitempty"`
+}
+
+// newTagFilter creates filter of tag with key flattened the same way, as dbmodel stores it, and original key
+// to look up log fields, which are stored unflattened. Dotted key is also split to path, so tags stored as nested
+// objects are found. Operator is taken from prefix of value (see parseTagOperator). Typed forms of value are set,
+// when value parses as number or boolean, because dbmodel keeps types of tag values
+func newTagFilter(key, value string) (tagFilter, error) {
+	if !validTagKey(key) {
+		return tagFilter{}, ErrInvalidTagKey
+	}
+
+	op, operand := parseTagOperator(value)
+	filter := tagFilter{
+		Name:  key,
+		Key:   strings.ReplaceAll(key, ".", TagDotReplacementCharacter),
+		Op:    op,
+		Value: operand,
+	}
+
+	if path := strings.Split(key, "."); len(path) > 1 {
+		filter.Path = path
+	}
+
+	switch op {
+	case tagOpEqual, tagOpNotEqual:
+		filter.Number = parseTagNumber(operand)
+		// strconv.ParseBool accepts 1 and 0 as well, which would match numeric tags as booleans
+		if b := strings.ToLower(operand); b == "true" || b == "false" {
+			boolean := b == "true"
+			filter.Bool = &boolean
+		}
+	case tagOpGreater, tagOpGreaterOrEqual, tagOpLess, tagOpLessOrEqual:
+		if filter.Number = parseTagNumber(operand); filter.Number == nil {
+			return tagFilter{}, fmt.Errorf("%w: %s requires number, got %q", ErrInvalidTagValue, key, operand)
+		}
+	case tagOpContains:
+		if operand == "" {
+			return tagFilter{}, fmt.Errorf("%w: %s requires non-empty substring", ErrInvalidTagValue, key)
+		}
+	case tagOpRegex:
+		if operand == "" || len(operand) > maxTagRegexLength {
+			return tagFilter{}, fmt.Errorf("%w: %s requires regular expression of 1 to %d characters", ErrInvalidTagValue, key, maxTagRegexLength)
+		}
+		if _, err := regexp.Compile(operand); err != nil {
+			return tagFilter{}, fmt.Errorf("%w: %s has invalid regular expression: %s", ErrInvalidTagValue, key, err)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseTagOperator splits tag value of query to operator and operand:
+// ~regex, !=value, >=number, >number, <=number, <number, *substring* or exact value.
+// Leading backslash is dropped and the rest is matched exactly, so values starting with operators can be found
+func parseTagOperator(value string) (op, operand string) {
+	switch {
+	case strings.HasPrefix(value, `\`):
+		return tagOpEqual, value[1:]
+	case strings.HasPrefix(value, "~"):
+		return tagOpRegex, value[1:]
+	case strings.HasPrefix(value, "!="):
+		return tagOpNotEqual, value[2:]
+	case strings.HasPrefix(value, ">="):
+		return tagOpGreaterOrEqual, value[2:]
+	case strings.HasPrefix(value, ">"):
+		return tagOpGreater, value[1:]
+	case strings.HasPrefix(value, "<="):
+		return tagOpLessOrEqual, value[2:]
+	case strings.HasPrefix(value, "<"):
+		return tagOpLess, value[1:]
+	case len(value) >= 2 && strings.HasPrefix(value, "*") && strings.HasSuffix(value, "*"):
+		return tagOpContains, value[1 : len(value)-1]
+	}
+	return tagOpEqual, value
+}
+
+func parseTagNumber(value string) *float64 {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil
+	}
+	return &number
+}
+
+// tagFilters converts query tags to filters and assigns regular expressions to parameter slots.
+// Error tag is reported separately, because error spans are marked at ingestion time and found by HasError column
+// (with fallback to the tag itself for spans ingested before the column existed)
+func tagFilters(tags map[string]string) (filters []tagFilter, hasError bool, err error) {
+	for k, v := range tags {
+		if k == errorTag && strings.EqualFold(v, "true") {
+			hasError = true
+			continue
+		}
+		filter, err := newTagFilter(k, v)
+		if err != nil {
+			return nil, false, err
+		}
+		filters = append(filters, filter)
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Key < filters[j].Key })
+
+	regexes := 0
+	for i := range filters {
+		if filters[i].Op != tagOpRegex {
+			continue
+		}
+		if regexes == maxTagRegexes {
+			return nil, false, fmt.Errorf("%w: at most %d regular expressions are allowed", ErrInvalidTagValue, maxTagRegexes)
+		}
+		slot := regexes
+		filters[i].Regex = &slot
+		regexes++
+	}
+
+	return filters, hasError, nil
+}
+
+// setTagFiltersParameters declares ParamTags and regular expression parameters referenced by tag filters query
+func setTagFiltersParameters(definitions kusto.ParamTypes, parameters kusto.QueryValues, filters []tagFilter) {
+	definitions["ParamTags"] = kusto.ParamType{Type: types.Dynamic}
+	parameters["ParamTags"] = filters
+
+	// all slots are referenced by query, unused ones never match as their filters don't exist
+	for _, name := range tagRegexParameters {
+		definitions[name] = kusto.ParamType{Type: types.String}
+		parameters[name] = ""
+	}
+	for _, filter := range filters {
+		if filter.Regex != nil {
+			parameters[tagRegexParameters[*filter.Regex]] = filter.Value
+		}
+	}
+}
+
+func validTagKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/jaegertracing/jaeger/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewTagFilter(testing *testing.T) {
+	cases := []struct {
+		key      string
+		value    string
+		expected string
+	}{
+		{key: "component", value: "http", expected: `{"name":"component","key":"component","op":"eq","value":"http"}`},
+		{key: "http.status_code", value: "500", expected: `{"name":"http.status_code","key":"http_status_code","path":["http","status_code"],"op":"eq","value":"500","number":500}`},
+		{key: "retry", value: "0.5", expected: `{"name":"retry","key":"retry","op":"eq","value":"0.5","number":0.5}`},
+		{key: "sampler.param", value: "True", expected: `{"name":"sampler.param","key":"sampler_param","path":["sampler","param"],"op":"eq","value":"True","bool":true}`},
+		{key: "cached", value: "false", expected: `{"name":"cached","key":"cached","op":"eq","value":"false","bool":false}`},
+		{key: "flag", value: "1", expected: `{"name":"flag","key":"flag","op":"eq","value":"1","number":1}`},
+		{key: "value", value: "NaN", expected: `{"name":"value","key":"value","op":"eq","value":"NaN"}`},
+		{key: "status", value: "!=200", expected: `{"name":"status","key":"status","op":"ne","value":"200","number":200}`},
+		{key: "http.status_code", value: ">=500", expected: `{"name":"http.status_code","key":"http_status_code","path":["http","status_code"],"op":"ge","value":"500","number":500}`},
+		{key: "size", value: ">1e3", expected: `{"name":"size","key":"size","op":"gt","value":"1e3","number":1000}`},
+		{key: "size", value: "<=10", expected: `{"name":"size","key":"size","op":"le","value":"10","number":10}`},
+		{key: "size", value: "<0.5", expected: `{"name":"size","key":"size","op":"lt","value":"0.5","number":0.5}`},
+		{key: "http.url", value: "*/api/*", expected: `{"name":"http.url","key":"http_url","path":["http","url"],"op":"contains","value":"/api/"}`},
+		{key: "http.url", value: "~^/api/v[0-9]+/", expected: `{"name":"http.url","key":"http_url","path":["http","url"],"op":"regex","value":"^/api/v[0-9]+/"}`},
+		{key: "peer", value: `\~home`, expected: `{"name":"peer","key":"peer","op":"eq","value":"~home"}`},
+		{key: "error.object", value: `\<nil>`, expected: `{"name":"error.object","key":"error_object","path":["error","object"],"op":"eq","value":"<nil>"}`},
+		{key: "peer", value: "*", expected: `{"name":"peer","key":"peer","op":"eq","value":"*"}`},
+		{key: "a.b.c", value: "", expected: `{"name":"a.b.c","key":"a_b_c","path":["a","b","c"],"op":"eq","value":""}`},
+	}
+
+	for _, c := range cases {
+		filter, err := newTagFilter(c.key, c.value)
+		assert.NoError(testing, err)
+		actual, err := json.Marshal(filter)
+		assert.NoError(testing, err)
+		assert.JSONEq(testing, c.expected, string(actual))
+	}
+}
+
+func Test_NewTagFilter_Invalid(testing *testing.T) {
+	cases := []struct {
+		key      string
+		value    string
+		expected error
+	}{
+		{key: "", value: "value", expected: ErrInvalidTagKey},
+		{key: "http\nurl", value: "value", expected: ErrInvalidTagKey},
+		{key: "http.status_code", value: ">=error", expected: ErrInvalidTagValue},
+		{key: "size", value: "<NaN", expected: ErrInvalidTagValue},
+		{key: "size", value: ">", expected: ErrInvalidTagValue},
+		{key: "error.object", value: "<nil>", expected: ErrInvalidTagValue},
+		{key: "http.url", value: "**", expected: ErrInvalidTagValue},
+		{key: "http.url", value: "~", expected: ErrInvalidTagValue},
+		{key: "http.url", value: "~(unclosed", expected: ErrInvalidTagValue},
+		{key: "http.url", value: "~" + strings.Repeat("a", maxTagRegexLength+1), expected: ErrInvalidTagValue},
+	}
+
+	for _, c := range cases {
+		_, err := newTagFilter(c.key, c.value)
+		assert.ErrorIs(testing, err, c.expected)
+	}
+}
+
+func Test_TagValues_DeepestPathFirst(testing *testing.T) {
+	for _, column := range []string{"Tags", "ProcessTags"} {
+		key := column + "[TagKey]"
+		deep := column + "[TagPath0][TagPath1][TagPath2]"
+		shallow := column + "[TagPath0][TagPath1])"
+
+		// nested object found by shallower path of a.b.c is not null, so it would hide the tag
+		assert.Contains(testing, tagValues, "coalesce("+key+", "+deep+", "+shallow)
+	}
+}
+
+func Test_TagFiltersLogsQuery_StoredLogs(testing *testing.T) {
+	span := &model.Span{
+		TraceID:   model.NewTraceID(0, 1),
+		SpanID:    model.NewSpanID(2),
+		StartTime: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Process:   &model.Process{ServiceName: "frontend"},
+		Logs: []model.Log{{
+			Timestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+			Fields:    []model.KeyValue{model.String("event", "retry"), model.Int64("http.status_code", 503)},
+		}},
+	}
+
+	values, err := TransformSpanToStringArray(span)
+	assert.NoError(testing, err)
+	row := make(map[string]string)
+	for i, column := range kustoSpanColumns() {
+		row[column.Name] = values[i]
+	}
+
+	// query reads fields of each log entry as key/value objects and looks them up by tag name,
+	// so stored logs must have the same shape and keep dots in keys
+	assert.Contains(testing, tagFiltersLogsQuery, "mv-expand LogField = LogEntry.fields")
+	assert.Contains(testing, tagFiltersLogsQuery, "make_list(LogField.value) by LogKey = tostring(LogField.key)")
+	assert.Contains(testing, tagFiltersLogsQuery, "KeyValues[tostring(TagFilter.name)]")
+
+	var logs []struct {
+		Fields []struct {
+			Key   string      `json:"key"`
+			Value interface{} `json:"value"`
+		} `json:"fields"`
+	}
+	assert.NoError(testing, json.Unmarshal([]byte(row["Logs"]), &logs))
+
+	keyValues := make(map[string][]interface{})
+	for _, log := range logs {
+		for _, field := range log.Fields {
+			keyValues[field.Key] = append(keyValues[field.Key], field.Value)
+		}
+	}
+	filters, _, err := tagFilters(map[string]string{"event": "retry", "http.status_code": ">=500"})
+	assert.NoError(testing, err)
+	for _, filter := range filters {
+		assert.Contains(testing, keyValues, filter.Name)
+	}
+	assert.Equal(testing, []interface{}{"retry"}, keyValues["event"])
+	assert.Equal(testing, []interface{}{"503"}, keyValues["http.status_code"])
+}
+
+func Test_TagFilters(testing *testing.T) {
+	filters, hasError, err := tagFilters(map[string]string{"error": "true", "http.method": "GET", "component": "grpc"})
+	assert.NoError(testing, err)
+	assert.True(testing, hasError)
+	assert.Equal(testing, []string{"component", "http_method"}, []string{filters[0].Key, filters[1].Key})
+
+	filters, hasError, err = tagFilters(map[string]string{"error": "false"})
+	assert.NoError(testing, err)
+	assert.False(testing, hasError)
+	assert.Len(testing, filters, 1)
+	assert.Equal(testing, "error", filters[0].Key)
+}
+
+func Test_TagFilters_Regexes(testing *testing.T) {
+	tags := map[string]string{"a": "~a", "b": "b", "c": "~c", "d": "~d"}
+	filters, _, err := tagFilters(tags)
+	assert.NoError(testing, err)
+
+	slots := map[string]int{}
+	for _, filter := range filters {
+		if filter.Regex != nil {
+			slots[filter.Key] = *filter.Regex
+		}
+	}
+	assert.Equal(testing, map[string]int{"a": 0, "c": 1, "d": 2}, slots)
+
+	definitions := make(kusto.ParamTypes)
+	parameters := make(kusto.QueryValues)
+	setTagFiltersParameters(definitions, parameters, filters)
+	assert.Equal(testing, "a", parameters["ParamTagRegex0"])
+	assert.Equal(testing, "c", parameters["ParamTagRegex1"])
+	assert.Equal(testing, "d", parameters["ParamTagRegex2"])
+	assert.Len(testing, definitions, 1+maxTagRegexes)
+
+	tags["e"] = "~e"
+	_, _, err = tagFilters(tags)
+	assert.ErrorIs(testing, err, ErrInvalidTagValue)
+}
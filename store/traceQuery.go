@@ -0,0 +1,88 @@
+package store
+
+import (
+	"github.com/Azure/azure-kusto-go/kusto"
+	"github.com/Azure/azure-kusto-go/kusto/data/types"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// traceQuery builds statement of FindTraceIDs (withSpans is false) and FindTraces (withSpans is true),
+// so both methods find the same traces by the same query. Query must be validated by validateQuery.
+// Duration bounds are inclusive, like in Jaeger Elasticsearch backend
+func (r *kustoSpanReader) traceQuery(query *spanstore.TraceQueryParameters, withSpans bool) (kusto.Stmt, error) {
+	kustoStmt := kusto.NewStmt("table(ParamTable)")
+	if withSpans {
+		kustoStmt = kusto.NewStmt("let TraceIDs = (table(ParamTable)")
+	}
+	kustoDefinitions := make(kusto.ParamTypes)
+	kustoParameters := make(kusto.QueryValues)
+
+	kustoDefinitions["ParamTable"] = kusto.ParamType{Type: types.String}
+	kustoParameters["ParamTable"] = r.tables.Spans
+
+	if query.ServiceName != "" {
+		kustoStmt = kustoStmt.Add(` | where ProcessServiceName == ParamProcessServiceName`)
+		kustoDefinitions["ParamProcessServiceName"] = kusto.ParamType{Type: types.String}
+		kustoParameters["ParamProcessServiceName"] = query.ServiceName
+	}
+
+	if query.OperationName != "" {
+		kustoStmt = kustoStmt.Add(` | where OperationName == ParamOperationName`)
+		kustoDefinitions["ParamOperationName"] = kusto.ParamType{Type: types.String}
+		kustoParameters["ParamOperationName"] = query.OperationName
+	}
+
+	filters, hasError, err := tagFilters(query.Tags)
+	if err != nil {
+		return kusto.Stmt{}, err
+	}
+	if hasError {
+		// tables not migrated yet have no HasError column, and spans ingested before migration have it empty,
+		// so error tag is checked too
+		kustoStmt = kustoStmt.Add(` | where column_ifexists("HasError", false) or tostring(Tags.error) == "true"`)
+	}
+	if len(filters) > 0 && r.searchLogs {
+		kustoStmt = kustoStmt.Add(tagFiltersLogsQuery)
+		setTagFiltersParameters(kustoDefinitions, kustoParameters, filters)
+	} else if len(filters) > 0 {
+		kustoStmt = kustoStmt.Add(tagFiltersQuery)
+		setTagFiltersParameters(kustoDefinitions, kustoParameters, filters)
+	}
+
+	kustoStmt = kustoStmt.Add(` | where StartTime > ParamStartTimeMin | where StartTime < ParamStartTimeMax`)
+	kustoDefinitions["ParamStartTimeMin"] = kusto.ParamType{Type: types.DateTime}
+	kustoParameters["ParamStartTimeMin"] = query.StartTimeMin
+	kustoDefinitions["ParamStartTimeMax"] = kusto.ParamType{Type: types.DateTime}
+	kustoParameters["ParamStartTimeMax"] = query.StartTimeMax
+
+	if query.DurationMin != 0 {
+		kustoStmt = kustoStmt.Add(` | where Duration >= ParamDurationMin`)
+		kustoDefinitions["ParamDurationMin"] = kusto.ParamType{Type: types.Timespan}
+		kustoParameters["ParamDurationMin"] = query.DurationMin
+	}
+
+	if query.DurationMax != 0 {
+		kustoStmt = kustoStmt.Add(` | where Duration <= ParamDurationMax`)
+		kustoDefinitions["ParamDurationMax"] = kusto.ParamType{Type: types.Timespan}
+		kustoParameters["ParamDurationMax"] = query.DurationMax
+	}
+
+	kustoStmt = kustoStmt.Add(` | summarize by TraceID`)
+
+	numTraces := query.NumTraces
+	if numTraces == 0 && withSpans {
+		numTraces = defaultNumTraces
+	}
+	if numTraces != 0 {
+		kustoStmt = kustoStmt.Add(` | sample ParamNumTraces`)
+		kustoDefinitions["ParamNumTraces"] = kusto.ParamType{Type: types.Int}
+		kustoParameters["ParamNumTraces"] = int32(numTraces)
+	}
+
+	if withSpans {
+		// spans of found traces are searched in the same time range, which limits scanned extents
+		kustoStmt = kustoStmt.Add(`); table(ParamTable) | where StartTime > ParamStartTimeMin | where StartTime < ParamStartTimeMax | where TraceID in (TraceIDs)`)
+	}
+
+	return kustoStmt.MustDefinitions(kusto.NewDefinitions().Must(kustoDefinitions)).MustParameters(kusto.NewParameters().Must(kustoParameters)), nil
+}
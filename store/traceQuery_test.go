@@ -0,0 +1,212 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KustoSpanReader_TraceQuery(testing *testing.T) {
+	startTimeMin := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	startTimeMax := time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC)
+	timeParams := map[string]string{
+		"ParamTable":        "Spans",
+		"ParamStartTimeMin": "datetime(2022-01-01T00:00:00Z)",
+		"ParamStartTimeMax": "datetime(2022-01-01T01:00:00Z)",
+	}
+	tagParams := func(tags string, regexes ...string) map[string]string {
+		params := map[string]string{"ParamTags": "dynamic(" + tags + ")", "ParamTagRegex0": "", "ParamTagRegex1": "", "ParamTagRegex2": ""}
+		for i, regex := range regexes {
+			params[tagRegexParameters[i]] = regex
+		}
+		return params
+	}
+
+	const timeFilters = ` | where StartTime > ParamStartTimeMin | where StartTime < ParamStartTimeMax`
+
+	cases := []struct {
+		name       string
+		query      spanstore.TraceQueryParameters
+		searchLogs bool
+		// expected query and parameters of FindTraceIDs, FindTraces wraps them
+		expected string
+		params   map[string]string
+	}{
+		{
+			name:     "time range",
+			query:    spanstore.TraceQueryParameters{},
+			expected: `table(ParamTable)` + timeFilters + ` | summarize by TraceID`,
+		},
+		{
+			name:     "service",
+			query:    spanstore.TraceQueryParameters{ServiceName: "frontend"},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName` + timeFilters + ` | summarize by TraceID`,
+			params:   map[string]string{"ParamProcessServiceName": "frontend"},
+		},
+		{
+			name:     "service and operation",
+			query:    spanstore.TraceQueryParameters{ServiceName: "frontend", OperationName: "GET /"},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName | where OperationName == ParamOperationName` + timeFilters + ` | summarize by TraceID`,
+			params:   map[string]string{"ParamProcessServiceName": "frontend", "ParamOperationName": "GET /"},
+		},
+		{
+			name:     "operation",
+			query:    spanstore.TraceQueryParameters{OperationName: "GET /"},
+			expected: `table(ParamTable) | where OperationName == ParamOperationName` + timeFilters + ` | summarize by TraceID`,
+			params:   map[string]string{"ParamOperationName": "GET /"},
+		},
+		{
+			name:     "error tag",
+			query:    spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"error": "true"}},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName | where column_ifexists("HasError", false) or tostring(Tags.error) == "true"` + timeFilters + ` | summarize by TraceID`,
+			params:   map[string]string{"ParamProcessServiceName": "frontend"},
+		},
+		{
+			name:     "tags",
+			query:    spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"error": "true", "component": "http"}},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName | where column_ifexists("HasError", false) or tostring(Tags.error) == "true"` + tagFiltersQuery + timeFilters + ` | summarize by TraceID`,
+			params: merge(map[string]string{"ParamProcessServiceName": "frontend"},
+				tagParams(`[{"name":"component","key":"component","op":"eq","value":"http"}]`)),
+		},
+		{
+			name:       "tags with logs",
+			query:      spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"event": "retry"}},
+			searchLogs: true,
+			expected:   `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName` + tagFiltersLogsQuery + timeFilters + ` | summarize by TraceID`,
+			params: merge(map[string]string{"ParamProcessServiceName": "frontend"},
+				tagParams(`[{"name":"event","key":"event","op":"eq","value":"retry"}]`)),
+		},
+		{
+			name:     "tag operators",
+			query:    spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"http.status_code": ">=500", "http.url": "~^/api/"}},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName` + tagFiltersQuery + timeFilters + ` | summarize by TraceID`,
+			params: merge(map[string]string{"ParamProcessServiceName": "frontend"},
+				tagParams(`[{"name":"http.status_code","key":"http_status_code","path":["http","status_code"],"op":"ge","value":"500","number":500},`+
+					`{"name":"http.url","key":"http_url","path":["http","url"],"op":"regex","value":"^/api/","regex":0}]`, "^/api/")),
+		},
+		{
+			name:     "duration min",
+			query:    spanstore.TraceQueryParameters{DurationMin: time.Second},
+			expected: `table(ParamTable)` + timeFilters + ` | where Duration >= ParamDurationMin | summarize by TraceID`,
+			params:   map[string]string{"ParamDurationMin": "timespan(00:00:01)"},
+		},
+		{
+			name:     "duration max",
+			query:    spanstore.TraceQueryParameters{DurationMax: 2 * time.Second},
+			expected: `table(ParamTable)` + timeFilters + ` | where Duration <= ParamDurationMax | summarize by TraceID`,
+			params:   map[string]string{"ParamDurationMax": "timespan(00:00:02)"},
+		},
+		{
+			name:     "duration range",
+			query:    spanstore.TraceQueryParameters{DurationMin: time.Second, DurationMax: 2 * time.Second},
+			expected: `table(ParamTable)` + timeFilters + ` | where Duration >= ParamDurationMin | where Duration <= ParamDurationMax | summarize by TraceID`,
+			params:   map[string]string{"ParamDurationMin": "timespan(00:00:01)", "ParamDurationMax": "timespan(00:00:02)"},
+		},
+		{
+			name:     "exact duration",
+			query:    spanstore.TraceQueryParameters{DurationMin: time.Second, DurationMax: time.Second},
+			expected: `table(ParamTable)` + timeFilters + ` | where Duration >= ParamDurationMin | where Duration <= ParamDurationMax | summarize by TraceID`,
+			params:   map[string]string{"ParamDurationMin": "timespan(00:00:01)", "ParamDurationMax": "timespan(00:00:01)"},
+		},
+		{
+			name:     "num traces",
+			query:    spanstore.TraceQueryParameters{NumTraces: 50},
+			expected: `table(ParamTable)` + timeFilters + ` | summarize by TraceID | sample ParamNumTraces`,
+			params:   map[string]string{"ParamNumTraces": "int(50)"},
+		},
+		{
+			name: "all",
+			query: spanstore.TraceQueryParameters{
+				ServiceName:   "frontend",
+				OperationName: "GET /",
+				Tags:          map[string]string{"error": "true", "http.method": "!=GET"},
+				DurationMin:   time.Millisecond,
+				DurationMax:   time.Minute,
+				NumTraces:     10,
+			},
+			expected: `table(ParamTable) | where ProcessServiceName == ParamProcessServiceName | where OperationName == ParamOperationName | where column_ifexists("HasError", false) or tostring(Tags.error) == "true"` +
+				tagFiltersQuery + timeFilters + ` | where Duration >= ParamDurationMin | where Duration <= ParamDurationMax | summarize by TraceID | sample ParamNumTraces`,
+			params: merge(map[string]string{
+				"ParamProcessServiceName": "frontend",
+				"ParamOperationName":      "GET /",
+				"ParamDurationMin":        "timespan(00:00:00.001)",
+				"ParamDurationMax":        "timespan(00:01:00)",
+				"ParamNumTraces":          "int(10)",
+			}, tagParams(`[{"name":"http.method","key":"http_method","path":["http","method"],"op":"ne","value":"GET"}]`)),
+		},
+	}
+
+	for _, c := range cases {
+		reader := newTestSpanReader(&fakeReaderClient{})
+		reader.searchLogs = c.searchLogs
+
+		query := c.query
+		query.StartTimeMin = startTimeMin
+		query.StartTimeMax = startTimeMax
+		assert.NoError(testing, validateQuery(&query))
+
+		params := merge(timeParams, c.params)
+		stmt, err := reader.traceQuery(&query, false)
+		assert.NoError(testing, err)
+		assertStmt(testing, c.expected, params, stmt.String(), stmt.ValuesJSON)
+
+		// FindTraces samples default number of traces and selects their spans
+		expected := c.expected
+		if query.NumTraces == 0 {
+			expected += ` | sample ParamNumTraces`
+			params = merge(params, map[string]string{"ParamNumTraces": "int(20)"})
+		}
+		expected = `let TraceIDs = (` + expected + `); table(ParamTable)` + timeFilters + ` | where TraceID in (TraceIDs)`
+
+		stmt, err = reader.traceQuery(&query, true)
+		assert.NoError(testing, err)
+		assertStmt(testing, expected, params, stmt.String(), stmt.ValuesJSON)
+		assert.Equal(testing, c.query.NumTraces, query.NumTraces)
+	}
+}
+
+func Test_KustoSpanReader_TraceQuery_DurationBounds(testing *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		StartTimeMin: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+		DurationMax:  time.Second,
+	}
+
+	stmt, err := newTestSpanReader(&fakeReaderClient{}).traceQuery(query, true)
+	assert.NoError(testing, err)
+	assert.Contains(testing, stmt.String(), "Duration <= ParamDurationMax")
+	assert.NotContains(testing, stmt.String(), "Duration > ParamDurationMax")
+
+	query.DurationMin = 2 * time.Second
+	assert.Equal(testing, ErrDurationMinGreaterThanMax, validateQuery(query))
+}
+
+// assertStmt compares query of statement without parameter declarations and its parameter values
+func assertStmt(testing *testing.T, expected string, params map[string]string, stmt string, values func() (string, error)) {
+	testing.Helper()
+
+	// statement starts with declaration of parameters
+	parts := strings.SplitN(stmt, ";\n", 2)
+	assert.Len(testing, parts, 2)
+	assert.Equal(testing, expected, parts[len(parts)-1])
+
+	actual, err := values()
+	assert.NoError(testing, err)
+	expectedParams, err := json.Marshal(params)
+	assert.NoError(testing, err)
+	assert.JSONEq(testing, string(expectedParams), actual)
+}
+
+func merge(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,490 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const walExtension = ".wal"
+
+var errWALClosed = errors.New("write-ahead log is closed")
+
+// walFile is segment file opened for writing
+type walFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// spanWAL is disk-backed write-ahead log of span rows, segments are removed only after they are ingested
+type spanWAL struct {
+	mu       sync.Mutex
+	path     string
+	table    string
+	format   string
+	file     walFile
+	filePath string
+	size     int
+	offset   int64
+	record   *bytes.Buffer
+	scratch  *bytes.Buffer
+	encoder  spanEncoder
+	closed   bool
+	segments chan string
+	queue    []string
+	queueMu  sync.Mutex
+	timers   map[*time.Timer]struct{}
+	queued   chan struct{}
+	closing  chan struct{}
+	files    *regexp.Regexp
+	wg       sync.WaitGroup
+}
+
+func newSpanWAL(path, table, format string) (*spanWAL, error) {
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead log directory: %w", err)
+	}
+
+	scratch := &bytes.Buffer{}
+	w := &spanWAL{
+		path:     path,
+		table:    table,
+		format:   format,
+		record:   &bytes.Buffer{},
+		scratch:  scratch,
+		encoder:  newSpanEncoder(format, scratch),
+		segments: make(chan string),
+		queued:   make(chan struct{}, 1),
+		timers:   map[*time.Timer]struct{}{},
+		closing:  make(chan struct{}),
+		files:    tableFilePattern(table, `_\d{20}`, walExtension),
+	}
+
+	w.wg.Add(1)
+	go w.dispatch()
+
+	return w, nil
+}
+
+// Segments returns segments of table left by previous runs in order they were written
+func (w *spanWAL) Segments() ([]string, error) {
+	entries, err := os.ReadDir(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, entry := range entries {
+		if entry.IsDir() || !w.files.MatchString(entry.Name()) {
+			continue
+		}
+		segments = append(segments, filepath.Join(w.path, entry.Name()))
+	}
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+// Replay hands segments left by previous runs to workers. Segments not handed before close stay for next start
+func (w *spanWAL) Replay(segments []string) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for _, segment := range segments {
+			select {
+			case w.segments <- segment:
+			case <-w.closing:
+				return
+			}
+		}
+	}()
+}
+
+// Append writes row to active segment and seals it, when segment exceeds maxBytes
+func (w *spanWAL) Append(row []string, maxBytes int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errWALClosed
+	}
+
+	w.scratch.Reset()
+	if err := w.encoder.Encode(row); err != nil {
+		return err
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	// each record is prefixed with its length, so partially written record is detected on replay
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(w.scratch.Len()))
+	w.record.Reset()
+	w.record.Write(header[:])
+	w.record.Write(w.scratch.Bytes())
+	if n, err := w.file.Write(w.record.Bytes()); err != nil {
+		// partial record would be read as prefix of records appended after it, so it's cut off
+		if n > 0 && w.rollback() != nil {
+			_ = w.seal()
+		}
+		return err
+	}
+
+	w.offset += int64(w.record.Len())
+	w.size += w.scratch.Len()
+	if w.size > maxBytes {
+		return w.seal()
+	}
+	return nil
+}
+
+// Rotate seals active segment, if it has any rows
+func (w *spanWAL) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	return w.seal()
+}
+
+// Requeue queues segment, which failed to ingest, again after delay
+func (w *spanWAL) Requeue(segment string, delay time.Duration) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+
+	// segments not requeued before close stay for next start
+	select {
+	case <-w.closing:
+		return
+	default:
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		w.queueMu.Lock()
+		delete(w.timers, timer)
+		select {
+		case <-w.closing:
+			w.queueMu.Unlock()
+			return
+		default:
+		}
+		w.queue = append(w.queue, segment)
+		w.queueMu.Unlock()
+
+		w.notify()
+	})
+	w.timers[timer] = struct{}{}
+}
+
+// Pending returns number of sealed segments waiting for workers
+func (w *spanWAL) Pending() int {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+	return len(w.queue)
+}
+
+// Close seals active segment, hands queued segments to workers and stops handing segments to workers
+func (w *spanWAL) Close() error {
+	w.queueMu.Lock()
+	close(w.closing)
+	for timer := range w.timers {
+		timer.Stop()
+	}
+	w.timers = nil
+	w.queueMu.Unlock()
+	w.wg.Wait()
+
+	w.mu.Lock()
+	w.closed = true
+	err := w.seal()
+	w.mu.Unlock()
+
+	for {
+		segment, ok := w.dequeue()
+		if !ok {
+			break
+		}
+		w.segments <- segment
+	}
+	close(w.segments)
+	return err
+}
+
+// dispatch hands queued segments to workers until close
+func (w *spanWAL) dispatch() {
+	defer w.wg.Done()
+
+	for {
+		segment, ok := w.peek()
+		if !ok {
+			select {
+			case <-w.queued:
+				continue
+			case <-w.closing:
+				return
+			}
+		}
+
+		select {
+		case w.segments <- segment:
+			w.dequeue()
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+func (w *spanWAL) enqueue(segment string) {
+	w.queueMu.Lock()
+	w.queue = append(w.queue, segment)
+	w.queueMu.Unlock()
+
+	w.notify()
+}
+
+// notify wakes up dispatch waiting for queued segments
+func (w *spanWAL) notify() {
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (w *spanWAL) peek() (string, bool) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+
+	if len(w.queue) == 0 {
+		return "", false
+	}
+	return w.queue[0], true
+}
+
+func (w *spanWAL) dequeue() (string, bool) {
+	w.queueMu.Lock()
+	defer w.queueMu.Unlock()
+
+	if len(w.queue) == 0 {
+		return "", false
+	}
+	segment := w.queue[0]
+	w.queue = w.queue[1:]
+	return segment, true
+}
+
+func (w *spanWAL) open() error {
+	name := fmt.Sprintf("%s_%020d.%s%s", w.table, time.Now().UnixNano(), w.format, walExtension)
+	path := filepath.Join(w.path, name)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.filePath = path
+	w.size = 0
+	w.offset = 0
+	return nil
+}
+
+// rollback removes partially written record from active segment
+func (w *spanWAL) rollback() error {
+	if err := w.file.Truncate(w.offset); err != nil {
+		return err
+	}
+	_, err := w.file.Seek(w.offset, io.SeekStart)
+	return err
+}
+
+func (w *spanWAL) seal() error {
+	if w.file == nil {
+		return nil
+	}
+
+	syncErr := w.file.Sync()
+	closeErr := w.file.Close()
+	path := w.filePath
+	w.file = nil
+	w.filePath = ""
+	w.size = 0
+	w.offset = 0
+
+	if syncErr != nil {
+		return syncErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	w.enqueue(path)
+	return nil
+}
+
+// readSegment returns rows of segment as batch payload and format, skipping partially written last record
+func readSegment(path string) (payload []byte, format string, truncated bool, err error) {
+	format = strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(path, walExtension)), ".")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, format, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	b := &bytes.Buffer{}
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF {
+				return b.Bytes(), format, false, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return b.Bytes(), format, true, nil
+			}
+			return nil, format, false, err
+		}
+
+		length := b.Len()
+		if _, err := io.CopyN(b, reader, int64(binary.BigEndian.Uint32(header[:]))); err != nil {
+			if err == io.EOF {
+				// record is cut, drop its part already copied to payload
+				b.Truncate(length)
+				return b.Bytes(), format, true, nil
+			}
+			return nil, format, false, err
+		}
+	}
+}
+
+// startWAL opens write-ahead log of table and replays segments left by previous runs, must precede workers start
+func (kw *kustoSpanWriter) startWAL(path, table string) error {
+	wal, err := newSpanWAL(path, table, kw.format)
+	if err != nil {
+		return err
+	}
+
+	segments, err := wal.Segments()
+	if err != nil {
+		return err
+	}
+
+	kw.wal = wal
+	wal.Replay(segments)
+
+	wal.wg.Add(1)
+	go kw.rotateWAL()
+
+	return nil
+}
+
+// rotateWAL seals active segment by batch timeout, so spans are ingested even if segment never fills up
+func (kw *kustoSpanWriter) rotateWAL() {
+	defer kw.wal.wg.Done()
+
+	_, batchTimeout := kw.batchOptions()
+	ticker := time.NewTicker(batchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := kw.wal.Rotate(); err != nil {
+				kw.logger.Error("Failed to seal write-ahead log segment", "error", err)
+			}
+
+			// pick up batch timeout changed by reconfiguration
+			if _, timeout := kw.batchOptions(); timeout != batchTimeout {
+				batchTimeout = timeout
+				ticker.Reset(batchTimeout)
+			}
+		case <-kw.wal.closing:
+			return
+		}
+	}
+}
+
+func (kw *kustoSpanWriter) segmentWorker(stop chan struct{}) {
+	defer kw.shutdownWg.Done()
+
+	for {
+		select {
+		case segment, ok := <-kw.wal.segments:
+			if !ok {
+				return
+			}
+			kw.ingestSegment(segment)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ingestSegment ingests sealed segment and removes it, failed segment is spilled to dead letter or requeued
+func (kw *kustoSpanWriter) ingestSegment(segment string) {
+	payload, format, truncated, err := readSegment(segment)
+	if err != nil {
+		kw.logger.Error("Failed to read write-ahead log segment, segment left for next start", "path", segment, "error", err)
+		return
+	}
+	if truncated {
+		kw.logger.Warn("Write-ahead log segment has partially written span, span dropped", "path", segment)
+	}
+
+	kw.observeBatch(batchTriggerSegment, len(payload))
+	kw.observeCompression(payload)
+	if len(payload) > 0 {
+		if err := kw.ingestWithRetry(payload, format); err != nil {
+			if kw.deadLetter == nil {
+				writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeKept).Inc()
+				kw.logger.Error("Failed to ingest to Kusto, segment queued for retry", "path", segment, "error", err)
+				kw.wal.Requeue(segment, kw.requeueDelay())
+				return
+			}
+
+			path, spillErr := kw.deadLetter.Spill(payload, format)
+			if spillErr != nil {
+				writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeKept).Inc()
+				kw.logger.Error("Failed to ingest to Kusto and spill segment to dead letter, segment queued for retry", "path", segment, "error", err, "spillError", spillErr)
+				kw.wal.Requeue(segment, kw.requeueDelay())
+				return
+			}
+			writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeSpilled).Inc()
+			kw.logger.Error("Failed to ingest to Kusto, segment spilled to dead letter", "path", path, "error", err)
+		}
+	}
+
+	if err := os.Remove(segment); err != nil {
+		kw.logger.Error("Failed to remove ingested write-ahead log segment", "path", segment, "error", err)
+		return
+	}
+	kw.logger.Debug("Ingested write-ahead log segment", "path", segment, "batchSize", len(payload))
+}
+
+// requeueDelay returns backoff before failed segment is ingested again, at least batch timeout
+func (kw *kustoSpanWriter) requeueDelay() time.Duration {
+	delay := kw.retry.Backoff(kw.retry.MaxAttempts + 1)
+	if _, batchTimeout := kw.batchOptions(); delay < batchTimeout {
+		delay = batchTimeout
+	}
+	return delay
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SpanWAL_ReadSegment(testing *testing.T) {
+	wal, err := newSpanWAL(testing.TempDir(), "Spans", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+
+	assert.NoError(testing, wal.Append([]string{"trace", "span"}, 1024))
+	assert.NoError(testing, wal.Append([]string{"trace", "span"}, 1024))
+	assert.NoError(testing, wal.Rotate())
+	segment := <-wal.segments
+
+	// simulate crash in the middle of record
+	file, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(testing, err)
+	_, err = file.Write([]byte{0, 0, 0, 16, '"'})
+	assert.NoError(testing, err)
+	assert.NoError(testing, file.Close())
+
+	payload, format, truncated, err := readSegment(segment)
+	assert.NoError(testing, err)
+	assert.True(testing, truncated)
+	assert.Equal(testing, config.WriterFormatCSV, format)
+	assert.Equal(testing, "\"trace\",\"span\"\n\"trace\",\"span\"\n", string(payload))
+}
+
+type shortWriteFile struct {
+	walFile
+}
+
+func (f shortWriteFile) Write(p []byte) (int, error) {
+	n, _ := f.walFile.Write(p[:len(p)/2])
+	return n, io.ErrShortWrite
+}
+
+func Test_SpanWAL_Append_ShortWrite(testing *testing.T) {
+	wal, err := newSpanWAL(testing.TempDir(), "Spans", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+
+	assert.NoError(testing, wal.Append([]string{"trace", "first"}, 1024))
+	file := wal.file
+	wal.file = shortWriteFile{file}
+	assert.ErrorIs(testing, wal.Append([]string{"trace", "failed"}, 1024), io.ErrShortWrite)
+	wal.file = file
+	assert.NoError(testing, wal.Append([]string{"trace", "last"}, 1024))
+	assert.NoError(testing, wal.Rotate())
+
+	payload, _, truncated, err := readSegment(<-wal.segments)
+	assert.NoError(testing, err)
+	assert.False(testing, truncated)
+	assert.Equal(testing, "\"trace\",\"first\"\n\"trace\",\"last\"\n", string(payload))
+}
+
+func Test_SpanWAL_Append_NoWorkers(testing *testing.T) {
+	wal, err := newSpanWAL(testing.TempDir(), "Spans", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+
+	// every append seals segment, nobody consumes them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			assert.NoError(testing, wal.Append([]string{"trace", "span"}, 1))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		testing.Fatal("append blocked on sealed segments")
+	}
+	assert.Equal(testing, 5, wal.Pending())
+}
+
+func Test_SpanWAL_Requeue_Close(testing *testing.T) {
+	wal, err := newSpanWAL(testing.TempDir(), "Spans", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+
+	wal.Requeue("segment", 20*time.Millisecond)
+	assert.NoError(testing, wal.Close())
+	wal.Requeue("segment", 0)
+
+	// timers are stopped by close, so segments stay for next start
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(testing, 0, wal.Pending())
+}
+
+func Test_KustoSpanWriter_WAL_Requeue(testing *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterRetryMaxAttempts = 1
+	pc.WriterRetryBackoffSeconds = 0
+	pc.WriterRetryMaxBackoffSeconds = 0
+	pc.WriterBatchTimeoutSeconds = 1
+
+	in := &fakeIngest{failures: 1}
+	writer := &kustoSpanWriter{
+		format:    config.WriterFormatCSV,
+		retry:     newRetryPolicy(pc),
+		ingest:    in,
+		logger:    hclog.NewNullLogger(),
+		spanInput: make(chan []string, pc.WriterSpanBufferSize),
+		closing:   make(chan struct{}),
+	}
+	assert.NoError(testing, writer.startWAL(testing.TempDir(), "Spans"))
+	writer.Reconfigure(pc)
+
+	assert.NoError(testing, writer.wal.Append([]string{"trace", "span"}, pc.WriterBatchMaxBytes))
+	assert.NoError(testing, writer.wal.Rotate())
+
+	// segment failed on first attempt is ingested again after batch timeout
+	assert.Eventually(testing, func() bool {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return in.rows == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	assert.NoError(testing, writer.Close())
+	segments, err := writer.wal.Segments()
+	assert.NoError(testing, err)
+	assert.Empty(testing, segments)
+}
+
+func Test_KustoSpanWriter_WAL(testing *testing.T) {
+	path := testing.TempDir()
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterBatchMaxBytes = 100
+
+	// segment left by previous run
+	previous, err := newSpanWAL(path, "Spans", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+	assert.NoError(testing, previous.Append([]string{"trace", "span"}, 1024))
+	assert.NoError(testing, previous.Rotate())
+	<-previous.segments
+
+	in := &fakeIngest{}
+	writer := &kustoSpanWriter{
+		format:    config.WriterFormatCSV,
+		retry:     newRetryPolicy(pc),
+		ingest:    in,
+		logger:    hclog.NewNullLogger(),
+		spanInput: make(chan []string, pc.WriterSpanBufferSize),
+		closing:   make(chan struct{}),
+	}
+	assert.NoError(testing, writer.startWAL(path, "Spans"))
+	writer.Reconfigure(pc)
+
+	// segments not replayed before close are left for next start
+	assert.Eventually(testing, func() bool {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return in.rows == 1
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(testing, writer.wal.Append([]string{"trace", "span"}, pc.WriterBatchMaxBytes))
+	}
+
+	assert.NoError(testing, writer.Close())
+	assert.Equal(testing, 51, in.rows)
+
+	segments, err := writer.wal.Segments()
+	assert.NoError(testing, err)
+	assert.Empty(testing, segments)
+}
@@ -2,29 +2,69 @@ package store
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
-	"github.com/tushar2708/altcsv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var errWriterClosed = status.Error(codes.Unavailable, "kusto writer is closed")
+
+// Triggers of batch ingestion
+const (
+	batchTriggerSize     = "size"
+	batchTriggerTime     = "time"
+	batchTriggerShutdown = "shutdown"
+	batchTriggerStop     = "stop"
+	batchTriggerSegment  = "segment"
+)
+
+// Outcomes of batch, which failed all ingestion attempts
+const (
+	batchOutcomeDropped = "dropped"
+	batchOutcomeSpilled = "spilled"
+	batchOutcomeKept    = "kept"
+)
+
+// kustoIngest ingests uncompressed batches to Kusto, both methods gzip the payload by themselves
 type kustoIngest interface {
 	FromReader(ctx context.Context, reader io.Reader, options ...ingest.FileOption) (*ingest.Result, error)
+	Stream(ctx context.Context, payload []byte, format ingest.DataFormat, mappingName string) error
 }
 
 type kustoSpanWriter struct {
+	failedBatches int64 // accessed atomically, first field to be 64-bit aligned
+	closed        int32 // accessed atomically, set once by Close
 	batchMaxBytes int
 	batchTimeout  time.Duration
-	workersCount  int
+	streaming     bool
+	compression   bool
+	overflow      overflowPolicy
+	table         string
+	format        string
+	mappingName   string
+	retry         *retryPolicy
+	deadLetter    *deadLetter
+	status        *ingestionStatusTracker
+	wal           *spanWAL
+	factory       *kustoFactory
 	ingest        kustoIngest
 	logger        hclog.Logger
 	spanInput     chan []string
-	shutdown      chan struct{}
+	closing       chan struct{}
+	workers       []chan struct{}
+	mu            sync.RWMutex
+	closeMu       sync.RWMutex // held for reading by writes in flight, so Close waits for them
 	shutdownWg    sync.WaitGroup
 }
 
@@ -35,94 +75,392 @@ func newKustoSpanWriter(factory *kustoFactory, logger hclog.Logger) (*kustoSpanW
 	}
 
 	writer := &kustoSpanWriter{
-		batchMaxBytes: factory.PluginConfig.WriterBatchMaxBytes,
-		batchTimeout:  time.Duration(factory.PluginConfig.WriterBatchTimeoutSeconds) * time.Second,
-		workersCount:  factory.PluginConfig.WriterWorkersCount,
-		ingest:        in,
-		logger:        logger,
-		spanInput:     make(chan []string, factory.PluginConfig.WriterSpanBufferSize),
-		shutdown:      make(chan struct{}),
-		shutdownWg:    sync.WaitGroup{},
+		format:      factory.PluginConfig.WriterFormat,
+		compression: factory.PluginConfig.WriterCompressionMetrics,
+		mappingName: factory.PluginConfig.KustoMappingName,
+		retry:       newRetryPolicy(factory.PluginConfig),
+		table:       factory.Tables.Spans,
+		factory:     factory,
+		ingest:      in,
+		logger:      logger,
+		spanInput:   make(chan []string, factory.PluginConfig.WriterSpanBufferSize),
+		closing:     make(chan struct{}),
+		shutdownWg:  sync.WaitGroup{},
+	}
+
+	// workers read dead letter and status tracker without lock, so both are set before workers start
+	if factory.PluginConfig.WriterDeadLetterPath != "" {
+		writer.deadLetter, err = newDeadLetter(factory.PluginConfig.WriterDeadLetterPath, factory.Tables.Spans, factory.PluginConfig.WriterDeadLetterMaxBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	for i := 0; i < writer.workersCount; i++ {
-		go writer.ingestWorker()
+	if factory.PluginConfig.WriterReportStatus {
+		timeout := time.Duration(factory.PluginConfig.WriterStatusTimeoutSeconds) * time.Second
+		writer.status = newIngestionStatusTracker(writer.table, timeout, logger)
+	}
+
+	if factory.PluginConfig.WriterWALPath != "" {
+		if err := writer.startWAL(factory.PluginConfig.WriterWALPath, factory.Tables.Spans); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Reconfigure(factory.PluginConfig)
+
+	writerBuffers.Add(writer)
+
+	if writer.deadLetter != nil {
+		writer.shutdownWg.Add(1)
+		go writer.replayDeadLetterLoop(time.Duration(factory.PluginConfig.WriterReplayIntervalSeconds) * time.Second)
 	}
 
 	return writer, nil
 }
 
-func (kw *kustoSpanWriter) WriteSpan(_ context.Context, span *model.Span) error {
+// Reconfigure applies batching options and starts or stops workers to match configured count
+func (kw *kustoSpanWriter) Reconfigure(pc *config.PluginConfig) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+
+	// workers started after close would never be stopped
+	if atomic.LoadInt32(&kw.closed) == 1 {
+		return
+	}
+
+	kw.batchMaxBytes = pc.WriterBatchMaxBytes
+	kw.batchTimeout = time.Duration(pc.WriterBatchTimeoutSeconds) * time.Second
+	kw.streaming = pc.WriterIngestionMode == config.IngestionModeStreaming
+	kw.overflow = newOverflowPolicy(pc)
+
+	for len(kw.workers) < pc.WriterWorkersCount {
+		kw.startWorker()
+	}
+	for len(kw.workers) > pc.WriterWorkersCount {
+		kw.stopWorker()
+	}
+}
+
+func (kw *kustoSpanWriter) batchOptions() (int, time.Duration) {
+	kw.mu.RLock()
+	defer kw.mu.RUnlock()
+	return kw.batchMaxBytes, kw.batchTimeout
+}
+
+func (kw *kustoSpanWriter) overflowOptions() overflowPolicy {
+	kw.mu.RLock()
+	defer kw.mu.RUnlock()
+	return kw.overflow
+}
+
+func (kw *kustoSpanWriter) ingestOptions() (kustoIngest, bool) {
+	kw.mu.RLock()
+	defer kw.mu.RUnlock()
+	return kw.ingest, kw.streaming
+}
+
+// ResetIngest recreates ingestion client, so it picks up changed credentials of Kusto client
+func (kw *kustoSpanWriter) ResetIngest() error {
+	in, err := kw.factory.Ingest()
+	if err != nil {
+		return err
+	}
+
+	kw.mu.Lock()
+	kw.ingest = in
+	kw.mu.Unlock()
+
+	return nil
+}
+
+func (kw *kustoSpanWriter) disableStreaming() {
+	kw.mu.Lock()
+	kw.streaming = false
+	kw.mu.Unlock()
+}
+
+func (kw *kustoSpanWriter) startWorker() {
+	stop := make(chan struct{})
+	kw.workers = append(kw.workers, stop)
+	kw.shutdownWg.Add(1)
+	if kw.wal != nil {
+		go kw.segmentWorker(stop)
+		return
+	}
+	go kw.ingestWorker(stop)
+}
+
+func (kw *kustoSpanWriter) stopWorker() {
+	last := len(kw.workers) - 1
+	close(kw.workers[last])
+	kw.workers = kw.workers[:last]
+}
+
+// WriteSpan sends span to workers or appends it to write-ahead log, applying overflow policy to full span buffer
+func (kw *kustoSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	kw.closeMu.RLock()
+	defer kw.closeMu.RUnlock()
+	if atomic.LoadInt32(&kw.closed) == 1 {
+		return errWriterClosed
+	}
+
+	writerSpansReceived.WithLabelValues(kw.table).Inc()
 	spanStringArray, err := TransformSpanToStringArray(span)
 
-	kw.spanInput <- spanStringArray
+	if kw.wal != nil {
+		batchMaxBytes, _ := kw.batchOptions()
+		if walErr := kw.wal.Append(spanStringArray, batchMaxBytes); walErr != nil {
+			return walErr
+		}
+		return err
+	}
+
+	if enqueueErr := kw.enqueue(ctx, span.TraceID, spanStringArray); enqueueErr != nil {
+		return enqueueErr
+	}
 	return err
 }
 
 func (kw *kustoSpanWriter) Close() error {
+	// wait for writes in flight, later writes are rejected
+	kw.closeMu.Lock()
+	if !atomic.CompareAndSwapInt32(&kw.closed, 0, 1) {
+		kw.closeMu.Unlock()
+		return nil
+	}
+	kw.closeMu.Unlock()
+
 	kw.logger.Debug("plugin shutdown started")
 
-	kw.shutdownWg.Add(kw.workersCount)
-	kw.shutdown <- struct{}{}
-	kw.shutdownWg.Wait()
+	// workers drain spans left in closed input and ingest their batches before exit
+	kw.mu.Lock()
 	close(kw.spanInput)
+	close(kw.closing)
+	kw.workers = nil
+	kw.mu.Unlock()
+
+	// workers ingest segments sealed by closed write-ahead log before exit
+	var err error
+	if kw.wal != nil {
+		err = kw.wal.Close()
+	}
+
+	kw.shutdownWg.Wait()
+
+	if kw.status != nil {
+		kw.status.Close()
+	}
+	writerBuffers.Remove(kw)
 
 	kw.logger.Debug("plugin shutdown completed")
-	return nil
+	return err
 }
 
-func (kw *kustoSpanWriter) ingestWorker() {
-	ticker := time.NewTicker(kw.batchTimeout)
+func (kw *kustoSpanWriter) ingestWorker(stop chan struct{}) {
+	defer kw.shutdownWg.Done()
+
+	batchMaxBytes, batchTimeout := kw.batchOptions()
+	ticker := time.NewTicker(batchTimeout)
 	defer ticker.Stop()
 
 	b := &bytes.Buffer{}
-	writer := altcsv.NewWriter(b)
-	writer.AllQuotes = true
+	encoder := newSpanEncoder(kw.format, b)
 
 	for {
 		select {
 		case spans, ok := <-kw.spanInput:
 			if !ok {
+				batchSize := b.Len()
+				kw.observeBatch(batchTriggerShutdown, batchSize)
+				kw.ingestBatch(b)
+				kw.logger.Debug("Ingested batch by shutdown", "batchSize", batchSize)
 				return
 			}
 			batchSize := b.Len()
-			if batchSize > kw.batchMaxBytes {
+			if batchSize > batchMaxBytes {
 				kw.logger.Debug("Ingested batch by size", "batchSize", batchSize)
+				kw.observeBatch(batchTriggerSize, batchSize)
 				kw.ingestBatch(b)
 			}
 			kw.logger.Debug("Append spans to batch buffer", "spanCount", len(spans))
-			err := writer.Write(spans)
-			if err != nil {
-				kw.logger.Error("Failed to write csv", "error", err)
+			if err := encoder.Encode(spans); err != nil {
+				kw.logger.Error("Failed to encode spans", "format", kw.format, "error", err)
 			}
-			writer.Flush()
 		case <-ticker.C:
 			batchSize := b.Len()
+			kw.observeBatch(batchTriggerTime, batchSize)
 			kw.ingestBatch(b)
 			kw.logger.Debug("Ingested batch by time", "batchSize", batchSize)
-		case <-kw.shutdown:
+
+			// pick up batching options changed by reconfiguration
+			maxBytes, timeout := kw.batchOptions()
+			batchMaxBytes = maxBytes
+			if timeout != batchTimeout {
+				batchTimeout = timeout
+				ticker.Reset(batchTimeout)
+			}
+		case <-stop:
 			batchSize := b.Len()
+			kw.observeBatch(batchTriggerStop, batchSize)
 			kw.ingestBatch(b)
-			kw.logger.Debug("Ingested batch by shutdown", "batchSize", batchSize)
-			kw.shutdownWg.Done()
+			kw.logger.Debug("Ingested batch by worker stop", "batchSize", batchSize)
 			return
 		}
 	}
 }
 
+// observeBatch counts batches passed to ingestion by trigger, empty batches are not ingested and not counted
+func (kw *kustoSpanWriter) observeBatch(trigger string, batchSize int) {
+	if batchSize == 0 {
+		return
+	}
+	writerBatches.WithLabelValues(kw.table, trigger).Inc()
+	writerBatchBytes.WithLabelValues(kw.table).Observe(float64(batchSize))
+}
+
+// observeCompression measures size of batch gzipped with default level, as ingestion SDK does before upload
+func (kw *kustoSpanWriter) observeCompression(payload []byte) {
+	if !kw.compression || len(payload) == 0 {
+		return
+	}
+
+	counter := &countingWriter{}
+	zw := gzip.NewWriter(counter)
+	if _, err := zw.Write(payload); err != nil {
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	writerBatchCompressedBytes.WithLabelValues(kw.table).Observe(float64(counter.n))
+}
+
+// countingWriter discards written bytes and counts them
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// ingestBatch ingests batch with retries, failed batch is spilled to dead letter (if configured) or dropped
 func (kw *kustoSpanWriter) ingestBatch(b *bytes.Buffer) {
 	if b.Len() == 0 {
 		return
 	}
+	defer b.Reset()
 
+	kw.observeCompression(b.Bytes())
+	err := kw.ingestWithRetry(b.Bytes(), kw.format)
+	if err == nil {
+		return
+	}
+
+	if kw.deadLetter == nil {
+		writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeDropped).Inc()
+		kw.logger.Error("Failed to ingest to Kusto, batch dropped", "batchSize", b.Len(), "error", err)
+		return
+	}
+
+	path, spillErr := kw.deadLetter.Spill(b.Bytes(), kw.format)
+	if spillErr != nil {
+		writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeDropped).Inc()
+		kw.logger.Error("Failed to ingest to Kusto and spill batch to dead letter, batch dropped", "batchSize", b.Len(), "error", err, "spillError", spillErr)
+		return
+	}
+	writerBatchesFailed.WithLabelValues(kw.table, batchOutcomeSpilled).Inc()
+	kw.logger.Error("Failed to ingest to Kusto, batch spilled to dead letter", "batchSize", b.Len(), "path", path, "error", err)
+}
+
+// ingestWithRetry ingests payload, retrying failed attempts with exponential backoff
+func (kw *kustoSpanWriter) ingestWithRetry(payload []byte, format string) error {
+	var err error
+	for attempt := 1; attempt <= kw.retry.MaxAttempts; attempt++ {
+		if err = kw.ingestPayload(payload, format); err == nil {
+			atomic.StoreInt64(&kw.failedBatches, 0)
+			return nil
+		}
+		if attempt == kw.retry.MaxAttempts {
+			break
+		}
+
+		delay := kw.retry.Backoff(attempt)
+		kw.logger.Warn("Failed to ingest to Kusto, retrying", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
+
+	atomic.AddInt64(&kw.failedBatches, 1)
+	return err
+}
+
+// FailedBatches returns number of consecutive batches, which failed all ingestion attempts
+func (kw *kustoSpanWriter) FailedBatches() int64 {
+	return atomic.LoadInt64(&kw.failedBatches)
+}
+
+func (kw *kustoSpanWriter) ingestPayload(payload []byte, writerFormat string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	_, err := kw.ingest.FromReader(ctx, b, ingest.FileFormat(ingest.CSV))
+	format := ingestionFormat(writerFormat)
+
+	// columns are mapped by name for both formats, so table columns order doesn't matter
+	mappingName := kw.mappingName
+
+	in, streaming := kw.ingestOptions()
+	if streaming {
+		start := time.Now()
+		err := in.Stream(ctx, payload, format, mappingName)
+		kw.observeIngestion(config.IngestionModeStreaming, start, err)
+		if err == nil {
+			return nil
+		}
+
+		switch {
+		case err == ingest.ErrTooLarge:
+			kw.logger.Debug("Batch is too large for streaming, falling back to queued ingestion", "batchSize", len(payload))
+		case isStreamingDisabled(err):
+			kw.logger.Warn("Streaming ingestion is not enabled on table, switching to queued ingestion", "error", err)
+			kw.disableStreaming()
+		default:
+			kw.logger.Warn("Failed to stream to Kusto, falling back to queued ingestion", "error", err)
+		}
+	}
+
+	options := []ingest.FileOption{ingest.FileFormat(format)}
+	if mappingName != "" {
+		options = append(options, ingest.IngestionMappingRef(mappingName, format))
+	}
+	if kw.status != nil {
+		options = append(options, ingest.ReportResultToTable())
+	}
+
+	start := time.Now()
+	result, err := in.FromReader(ctx, bytes.NewReader(payload), options...)
+	kw.observeIngestion(config.IngestionModeQueued, start, err)
 	if err != nil {
-		kw.logger.Error("Failed to ingest to Kusto", "error", err)
-		return
+		return err
 	}
 
-	b.Reset()
+	if kw.status != nil {
+		kw.status.Track(result.Wait, len(payload))
+	}
+	return nil
+}
+
+func (kw *kustoSpanWriter) observeIngestion(mode string, start time.Time, err error) {
+	writerIngestionDuration.WithLabelValues(kw.table, mode).Observe(time.Since(start).Seconds())
+	if err != nil {
+		writerIngestionFailures.WithLabelValues(kw.table, mode).Inc()
+	}
+}
+
+// isStreamingDisabled returns true if error caused by streaming ingestion policy disabled on table or database
+func isStreamingDisabled(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "streamingingestionpolicynotenabled") ||
+		strings.Contains(message, "streaming ingestion policy is not enabled")
 }
@@ -0,0 +1,443 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-kusto-go/kusto/ingest"
+	"github.com/dodopizza/jaeger-kusto/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeIngest struct {
+	mu        sync.Mutex
+	rows      int
+	streamed  int
+	attempts  int
+	failures  int
+	streamErr error
+	mappings  []string
+}
+
+func (f *fakeIngest) FromReader(_ context.Context, reader io.Reader, _ ...ingest.FileOption) (*ingest.Result, error) {
+	b := &bytes.Buffer{}
+	if _, err := b.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("ingestion failed")
+	}
+	f.rows += strings.Count(b.String(), "\n")
+	return &ingest.Result{}, nil
+}
+
+func (f *fakeIngest) Stream(_ context.Context, payload []byte, _ ingest.DataFormat, mappingName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mappings = append(f.mappings, mappingName)
+	if f.streamErr != nil {
+		return f.streamErr
+	}
+	f.rows += strings.Count(string(payload), "\n")
+	f.streamed++
+	return nil
+}
+
+func newTestSpanWriter(in kustoIngest, pc *config.PluginConfig) *kustoSpanWriter {
+	writer := &kustoSpanWriter{
+		retry:     newRetryPolicy(pc),
+		ingest:    in,
+		logger:    hclog.NewNullLogger(),
+		spanInput: make(chan []string, pc.WriterSpanBufferSize),
+		closing:   make(chan struct{}),
+	}
+	writer.Reconfigure(pc)
+	return writer
+}
+
+func Test_KustoSpanWriter_Reconfigure(testing *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	in := &fakeIngest{}
+	writer := newTestSpanWriter(in, pc)
+	assert.Len(testing, writer.workers, pc.WriterWorkersCount)
+
+	for i := 0; i < 50; i++ {
+		writer.spanInput <- []string{"trace", "span"}
+	}
+
+	pc.WriterWorkersCount = 2
+	pc.WriterBatchMaxBytes = 100
+	writer.Reconfigure(pc)
+	assert.Len(testing, writer.workers, 2)
+	maxBytes, _ := writer.batchOptions()
+	assert.Equal(testing, 100, maxBytes)
+
+	for i := 0; i < 50; i++ {
+		writer.spanInput <- []string{"trace", "span"}
+	}
+
+	pc.WriterWorkersCount = 4
+	writer.Reconfigure(pc)
+	assert.Len(testing, writer.workers, 4)
+
+	assert.NoError(testing, writer.Close())
+	assert.Equal(testing, 100, in.rows)
+}
+
+func Test_KustoSpanWriter_Close_WritesInFlight(testing *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.WriterSpanBufferSize = 1
+	in := &fakeIngest{}
+	writer := newTestSpanWriter(in, pc)
+	span := &model.Span{TraceID: model.NewTraceID(0, 1), Process: &model.Process{ServiceName: "service"}}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := writer.WriteSpan(context.Background(), span)
+				if err != nil {
+					assert.Equal(testing, codes.Unavailable, status.Code(err))
+				}
+			}
+		}()
+	}
+
+	assert.NoError(testing, writer.Close())
+	wg.Wait()
+
+	assert.Equal(testing, codes.Unavailable, status.Code(writer.WriteSpan(context.Background(), span)))
+	writer.Reconfigure(pc)
+	assert.Empty(testing, writer.workers)
+	assert.NoError(testing, writer.Close())
+}
+
+func Test_KustoSpanWriter_IngestBatch_Streaming(testing *testing.T) {
+	cases := []struct {
+		name      string
+		streamErr error
+		streamed  int
+		streaming bool
+	}{
+		{"streamed", nil, 1, true},
+		{"too large", ingest.ErrTooLarge, 0, true},
+		{"policy disabled", errors.New("Kusto.DataNode.Exceptions.StreamingIngestionPolicyNotEnabledException"), 0, false},
+	}
+
+	for _, c := range cases {
+		in := &fakeIngest{streamErr: c.streamErr}
+		writer := &kustoSpanWriter{
+			retry:     &retryPolicy{MaxAttempts: 1},
+			ingest:    in,
+			logger:    hclog.NewNullLogger(),
+			streaming: true,
+		}
+
+		b := bytes.NewBufferString("\"trace\",\"span\"\n")
+		writer.ingestBatch(b)
+
+		assert.Equal(testing, 1, in.rows)
+		assert.Equal(testing, c.streamed, in.streamed)
+		assert.Equal(testing, 0, b.Len())
+		_, streaming := writer.ingestOptions()
+		assert.Equal(testing, c.streaming, streaming)
+	}
+}
+
+func Test_KustoSpanWriter_IngestBatch_Mapping(testing *testing.T) {
+	for _, format := range []string{config.WriterFormatCSV, config.WriterFormatJSON} {
+		in := &fakeIngest{}
+		writer := &kustoSpanWriter{
+			format:      format,
+			mappingName: "JaegerSpanMapping",
+			retry:       &retryPolicy{MaxAttempts: 1},
+			ingest:      in,
+			logger:      hclog.NewNullLogger(),
+			streaming:   true,
+		}
+
+		writer.ingestBatch(bytes.NewBufferString("\"trace\",\"span\"\n"))
+
+		assert.Equal(testing, []string{"JaegerSpanMapping"}, in.mappings, format)
+	}
+}
+
+func Test_KustoSpanWriter_IngestBatch_Retry(testing *testing.T) {
+	in := &fakeIngest{failures: 2}
+	writer := &kustoSpanWriter{
+		retry:  &retryPolicy{MaxAttempts: 3},
+		ingest: in,
+		logger: hclog.NewNullLogger(),
+	}
+
+	b := bytes.NewBufferString("\"trace\",\"span\"\n")
+	writer.ingestBatch(b)
+
+	assert.Equal(testing, 3, in.attempts)
+	assert.Equal(testing, 1, in.rows)
+	assert.Equal(testing, 0, b.Len())
+}
+
+func Test_KustoSpanWriter_IngestBatch_DeadLetter(testing *testing.T) {
+	dl, err := newDeadLetter(testing.TempDir(), "Spans", 0)
+	assert.NoError(testing, err)
+
+	in := &fakeIngest{failures: 2}
+	writer := &kustoSpanWriter{
+		format:     config.WriterFormatCSV,
+		retry:      &retryPolicy{MaxAttempts: 2},
+		deadLetter: dl,
+		ingest:     in,
+		logger:     hclog.NewNullLogger(),
+	}
+
+	b := bytes.NewBufferString("\"trace\",\"span\"\n")
+	writer.ingestBatch(b)
+
+	assert.Equal(testing, 0, in.rows)
+	assert.Equal(testing, 0, b.Len())
+	files, err := dl.Files()
+	assert.NoError(testing, err)
+	assert.Len(testing, files, 1)
+
+	writer.replayDeadLetter()
+
+	assert.Equal(testing, 1, in.rows)
+	files, err = dl.Files()
+	assert.NoError(testing, err)
+	assert.Empty(testing, files)
+}
+
+func Test_DeadLetter_Files(testing *testing.T) {
+	path := testing.TempDir()
+	dl, err := newDeadLetter(path, "Spans", 0)
+	assert.NoError(testing, err)
+
+	for _, name := range []string{
+		"Spans_1_2.csv",
+		"Spans_3_4.json",
+		"Spans_2024_1_2.csv",
+		"Spans_1_2.csv.tmp",
+		"Spans_1.csv",
+		"Spans_1_2.txt",
+		"Spans_00000000000000000001.csv.wal",
+	} {
+		assert.NoError(testing, os.WriteFile(filepath.Join(path, name), []byte("trace\n"), 0o640))
+	}
+
+	files, err := dl.Files()
+	assert.NoError(testing, err)
+	assert.Equal(testing, []string{filepath.Join(path, "Spans_1_2.csv"), filepath.Join(path, "Spans_3_4.json")}, files)
+}
+
+func Test_DeadLetter_Spill_MaxBytes(testing *testing.T) {
+	path := testing.TempDir()
+	dl, err := newDeadLetter(path, "Spans", 30)
+	assert.NoError(testing, err)
+
+	// temporary files and batches of other tables don't count
+	for _, name := range []string{"Spans_1_2.csv.tmp", "Archive_1_2.csv"} {
+		assert.NoError(testing, os.WriteFile(filepath.Join(path, name), bytes.Repeat([]byte("x"), 100), 0o640))
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dl.Spill([]byte("trace\n"), config.WriterFormatCSV); err != nil {
+				assert.ErrorIs(testing, err, errDeadLetterFull)
+			}
+		}()
+	}
+	wg.Wait()
+
+	files, err := dl.Files()
+	assert.NoError(testing, err)
+	assert.Len(testing, files, 5)
+	size, err := dl.Size()
+	assert.NoError(testing, err)
+	assert.Equal(testing, int64(30), size)
+}
+
+func Test_KustoSpanWriter_ReplayDeadLetterLoop(testing *testing.T) {
+	dl, err := newDeadLetter(testing.TempDir(), "Spans", 0)
+	assert.NoError(testing, err)
+
+	in := &fakeIngest{}
+	writer := &kustoSpanWriter{
+		retry:      &retryPolicy{MaxAttempts: 1},
+		deadLetter: dl,
+		ingest:     in,
+		logger:     hclog.NewNullLogger(),
+		closing:    make(chan struct{}),
+	}
+	writer.shutdownWg.Add(1)
+	go writer.replayDeadLetterLoop(10 * time.Millisecond)
+
+	// batch spilled after start is picked up by next replay
+	_, err = dl.Spill([]byte("\"trace\",\"span\"\n"), config.WriterFormatCSV)
+	assert.NoError(testing, err)
+	assert.Eventually(testing, func() bool {
+		files, _ := dl.Files()
+		return len(files) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	close(writer.closing)
+	writer.shutdownWg.Wait()
+	assert.Equal(testing, 1, in.rows)
+}
+
+func Test_RetryPolicy_Backoff(testing *testing.T) {
+	policy := &retryPolicy{MaxAttempts: 10, Initial: time.Second, Max: 4 * time.Second}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second} {
+		delay := policy.Backoff(attempt + 1)
+		assert.GreaterOrEqual(testing, delay, max/2)
+		assert.LessOrEqual(testing, delay, max)
+	}
+	assert.LessOrEqual(testing, policy.Backoff(100), 4*time.Second)
+}
+
+func Test_KustoSpanWriter_ObserveBatch(testing *testing.T) {
+	writer := &kustoSpanWriter{table: "Test_KustoSpanWriter_ObserveBatch"}
+
+	writer.observeBatch(batchTriggerTime, 0)
+	writer.observeBatch(batchTriggerTime, 10)
+	writer.observeBatch(batchTriggerSize, 10)
+
+	assert.Equal(testing, 1.0, testutil.ToFloat64(writerBatches.WithLabelValues(writer.table, batchTriggerTime)))
+	assert.Equal(testing, 1.0, testutil.ToFloat64(writerBatches.WithLabelValues(writer.table, batchTriggerSize)))
+}
+
+func Test_WriterBufferCollector(testing *testing.T) {
+	wal, err := newSpanWAL(testing.TempDir(), "Archive", config.WriterFormatCSV)
+	assert.NoError(testing, err)
+	assert.NoError(testing, wal.Append([]string{"trace", "span"}, 1))
+
+	first := &kustoSpanWriter{table: "Spans", spanInput: make(chan []string, 10)}
+	first.spanInput <- []string{"span"}
+	second := &kustoSpanWriter{table: "Spans", spanInput: make(chan []string, 10)}
+	second.spanInput <- []string{"span"}
+	second.spanInput <- []string{"span"}
+	archive := &kustoSpanWriter{table: "Archive", wal: wal}
+
+	collector := newWriterBufferCollector()
+	collector.Add(first)
+	collector.Add(second)
+	collector.Add(archive)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	expected := `
+# HELP jaeger_kusto_writer_buffered_spans Number of spans waiting in writer span buffer
+# TYPE jaeger_kusto_writer_buffered_spans gauge
+jaeger_kusto_writer_buffered_spans{table="Spans"} 3
+# HELP jaeger_kusto_writer_wal_pending_segments Number of sealed write-ahead log segments waiting for writer workers
+# TYPE jaeger_kusto_writer_wal_pending_segments gauge
+jaeger_kusto_writer_wal_pending_segments{table="Archive"} 1
+`
+	assert.NoError(testing, testutil.GatherAndCompare(registry, strings.NewReader(expected)))
+
+	collector.Remove(second)
+	assert.Equal(testing, 2, testutil.CollectAndCount(collector))
+}
+
+func Test_KustoSpanWriter_ObserveCompression(testing *testing.T) {
+	writer := &kustoSpanWriter{table: "Test_KustoSpanWriter_ObserveCompression"}
+	payload := bytes.Repeat([]byte("trace,span\n"), 1000)
+
+	histogram := func() *dto.Histogram {
+		metric := &dto.Metric{}
+		assert.NoError(testing, writerBatchCompressedBytes.WithLabelValues(writer.table).(prometheus.Histogram).Write(metric))
+		return metric.GetHistogram()
+	}
+
+	writer.observeCompression(payload)
+	assert.Equal(testing, uint64(0), histogram().GetSampleCount())
+
+	writer.compression = true
+	writer.observeCompression(payload)
+	assert.Equal(testing, uint64(1), histogram().GetSampleCount())
+	assert.Greater(testing, histogram().GetSampleSum(), 0.0)
+	assert.Less(testing, histogram().GetSampleSum(), float64(len(payload)))
+}
+
+func Test_NewKustoSpanWriter(testing *testing.T) {
+	pc := config.NewDefaultPluginConfig()
+	pc.KustoSpansTable = "Test_NewKustoSpanWriter"
+	pc.WriterWALPath = testing.TempDir()
+	pc.WriterDeadLetterPath = testing.TempDir()
+	pc.WriterReportStatus = true
+	pc.WriterRetryMaxAttempts = 1
+	pc.WriterBatchTimeoutSeconds = 1
+
+	// segment left by previous run, which fails to ingest on replay
+	previous, err := newSpanWAL(pc.WriterWALPath, pc.KustoSpansTable, config.WriterFormatCSV)
+	assert.NoError(testing, err)
+	assert.NoError(testing, previous.Append([]string{"trace", "span"}, 1024))
+	assert.NoError(testing, previous.Rotate())
+	<-previous.segments
+
+	in := &fakeIngest{failures: 1}
+	factory := &kustoFactory{
+		PluginConfig: pc,
+		Database:     "Database",
+		Tables:       newKustoTables(pc),
+		newIngest: func(string) (kustoIngest, error) {
+			return in, nil
+		},
+	}
+
+	writer, err := newKustoSpanWriter(factory, hclog.NewNullLogger())
+	assert.NoError(testing, err)
+
+	// replayed segment is spilled to dead letter, which is set before workers start,
+	// and is either left there or picked up by dead letter replay
+	assert.Eventually(testing, func() bool {
+		segments, _ := writer.wal.Segments()
+		files, _ := writer.deadLetter.Files()
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return len(segments) == 0 && len(files)+in.rows == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, uint64(i+1)),
+			SpanID:        model.NewSpanID(uint64(i + 1)),
+			OperationName: "operation",
+			Process:       model.NewProcess("service", nil),
+		}
+		assert.NoError(testing, writer.WriteSpan(context.Background(), span))
+	}
+	assert.NoError(testing, writer.Close())
+
+	files, err := writer.deadLetter.Files()
+	assert.NoError(testing, err)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	assert.Equal(testing, 11, len(files)+in.rows)
+}
@@ -86,6 +86,34 @@ func TestFindTraces(tester *testing.T) {
 	fmt.Printf("%+v\n", traces)
 }
 
+func TestFindTraceIDs_LogFields(tester *testing.T) {
+	query := spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		StartTimeMin: time.Date(2020, time.June, 10, 13, 0, 0, 0, time.UTC),
+		StartTimeMax: time.Date(2020, time.June, 10, 14, 0, 0, 0, time.UTC),
+		NumTraces:    20,
+		Tags: map[string]string{
+			"event":            "retry",
+			"http.status_code": ">=500",
+		},
+	}
+
+	pluginConfig := NewTestPluginConfig()
+	pluginConfig.ReaderSearchLogs = true
+
+	kustoConfig, _ := config.ParseKustoConfig(pluginConfig.KustoConfigPath)
+	kustoStore, _ := store.NewStore(pluginConfig, kustoConfig, logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	traceIDs, err := kustoStore.SpanReader().FindTraceIDs(ctx, &query)
+	if err != nil {
+		logger.Error("can't find trace ids", err.Error())
+	}
+	fmt.Printf("%+v\n", traceIDs)
+}
+
 func TestStore_DependencyReader(t *testing.T) {
 	kustoConfig, _ := config.ParseKustoConfig(testPluginConfig.KustoConfigPath)
 	kustoStore, _ := store.NewStore(testPluginConfig, kustoConfig, logger)